@@ -0,0 +1,92 @@
+package s3backend
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mabels/diener/ctx"
+)
+
+// cacheControlOverride is a rendered Cache-Control for the keys matching
+// pattern.
+type cacheControlOverride struct {
+	pattern string
+	value   string
+}
+
+// renderCacheControl renders the policy as Cache-Control header value,
+// no-store makes every other directive pointless.
+func renderCacheControl(cc ctx.CacheControl) string {
+	if cc.NoStore {
+		return "no-store"
+	}
+	directives := []string{}
+	if cc.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if cc.MaxAgeSeconds != nil {
+		directives = append(directives, "max-age="+strconv.Itoa(*cc.MaxAgeSeconds))
+	}
+	if cc.SMaxAgeSeconds != nil {
+		directives = append(directives, "s-maxage="+strconv.Itoa(*cc.SMaxAgeSeconds))
+	}
+	if cc.Immutable {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// newCacheControlOverrides renders the overrides and rejects malformed
+// patterns up front, path.Match would only report them on use.
+func newCacheControlOverrides(overrides []ctx.CacheControlOverride) ([]cacheControlOverride, error) {
+	ret := make([]cacheControlOverride, 0, len(overrides))
+	for _, o := range overrides {
+		pattern := strings.TrimPrefix(o.Pattern, "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("cache control pattern %q: %w", o.Pattern, err)
+		}
+		ret = append(ret, cacheControlOverride{
+			pattern: pattern,
+			value:   renderCacheControl(o.CacheControl),
+		})
+	}
+	return ret, nil
+}
+
+// matchKey matches a key against an override pattern. A pattern without
+// a slash matches the base name, a pattern ending in "/*" matches every
+// key below the directory, any other pattern matches the whole key.
+func matchKey(pattern, key string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(key))
+		return ok
+	}
+	if dir, found := strings.CutSuffix(pattern, "/*"); found {
+		depth := strings.Count(dir, "/") + 1
+		parts := strings.SplitN(key, "/", depth+1)
+		if len(parts) <= depth {
+			return false
+		}
+		ok, _ := path.Match(dir, strings.Join(parts[:depth], "/"))
+		return ok
+	}
+	ok, _ := path.Match(pattern, key)
+	return ok
+}
+
+// cacheControl is the Cache-Control sent for the key: the first matching
+// override wins over the one stored with the object, which wins over the
+// backend default.
+func (sss *S3BackendImpl) cacheControl(key string, stored string) string {
+	for _, o := range sss.cacheControlOverrides {
+		if matchKey(o.pattern, key) {
+			return o.value
+		}
+	}
+	if stored != "" {
+		return stored
+	}
+	return sss.defaultCacheControl
+}
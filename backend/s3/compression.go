@@ -0,0 +1,386 @@
+package s3backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// encodingExt are the key suffixes of precompressed variants, the order
+// is the preference of the server if the client has none.
+var encodingExt = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// defaultCompressibleTypes are compressed on the fly if no types are
+// configured.
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// defaultCompressMinSize keeps tiny objects from being compressed, the
+// encoded result would hardly be smaller.
+const defaultCompressMinSize = 1024
+
+func encodingSuffix(encoding string) string {
+	for _, e := range encodingExt {
+		if e.encoding == encoding {
+			return e.ext
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings are the content encodings diener supports which the
+// client accepts, most preferred first. "*" stands for all of them and
+// q=0 refuses an encoding.
+func acceptedEncodings(r *http.Request) []string {
+	type accepted struct {
+		encoding string
+		q        float64
+		order    int
+	}
+	refused := map[string]bool{}
+	found := []accepted{}
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			encoding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+			for i, e := range encodingExt {
+				if encoding != e.encoding && encoding != "*" {
+					continue
+				}
+				if q <= 0 {
+					refused[e.encoding] = true
+					continue
+				}
+				found = append(found, accepted{e.encoding, q, i})
+			}
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].q != found[j].q {
+			return found[i].q > found[j].q
+		}
+		return found[i].order < found[j].order
+	})
+	encodings := []string{}
+	seen := map[string]bool{}
+	for _, a := range found {
+		if !refused[a.encoding] && !seen[a.encoding] {
+			seen[a.encoding] = true
+			encodings = append(encodings, a.encoding)
+		}
+	}
+	return encodings
+}
+
+// variantETag tells encoded variants apart from the object they are
+// made of, caches must not mix them up in conditional requests.
+func variantETag(etag, encoding string) string {
+	if encoding == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// compressible reports if objects of the content type are compressed on
+// the fly, "text/*" matches every text type.
+func (sss *S3BackendImpl) compressible(ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	ctype = strings.ToLower(strings.TrimSpace(ctype))
+	types := sss.compression.Types
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	for _, t := range types {
+		if prefix, found := strings.CutSuffix(t, "/*"); found {
+			if strings.HasPrefix(ctype, prefix+"/") {
+				return true
+			}
+		} else if t == ctype {
+			return true
+		}
+	}
+	return false
+}
+
+func compress(encoding string, buf []byte) ([]byte, error) {
+	var out bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "br":
+		w = brotli.NewWriterLevel(&out, brotli.DefaultCompression)
+	case "gzip":
+		w = gzip.NewWriter(&out)
+	default:
+		return nil, fs.ErrInvalid
+	}
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// encodedHeader are the response headers of an encoded variant of the
+// object, the type is the one of the object and not of the variant.
+// Sniffing the encoded body would tell nothing.
+func (sss *S3BackendImpl) encodedHeader(key string, obj *s3.GetObjectOutput, encoding string) http.Header {
+	header := sss.responseHeader(key, obj)
+	header.Set("Content-Encoding", encoding)
+	if header.Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(key))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		header.Set("Content-Type", ctype)
+	}
+	return header
+}
+
+// objectOf is the key and metadata of an opened object, directories
+// have none.
+func objectOf(file http.File) (string, *s3.GetObjectOutput, bool) {
+	switch f := file.(type) {
+	case *S3CachedFile:
+		return f.name, f.obj, true
+	case *S3DirectFile:
+		return f.name, f.obj, true
+	case *S3MetaFile:
+		return f.name, f.obj, true
+	}
+	return "", nil, false
+}
+
+// OpenEncoded opens name like Open, but prefers a precompressed variant
+// or compresses the object on the fly if the client accepts one of the
+// encodings. The name is resolved with the metadata alone, the object
+// is only fetched if no precompressed variant is served.
+func (sss *S3BackendImpl) OpenEncoded(name string, encodings []string) (http.File, error) {
+	octx, span := sss.tracer.Start(sss.ctx, "OpenEncoded")
+	defer span.End()
+	span.AddEvent(name)
+
+	if len(encodings) == 0 || !sss.compression.Precompressed {
+		file, err := sss.Open(name)
+		if err != nil || len(encodings) == 0 {
+			return file, err
+		}
+		return sss.compressOnTheFly(octx, file, encodings[0]), nil
+	}
+	file, err := sss.open(name, "OpenMeta", sss.openMeta)
+	if err != nil {
+		return nil, err
+	}
+	key, obj, ok := objectOf(file)
+	if !ok {
+		return file, nil
+	}
+	if obj.ContentEncoding == nil {
+		for _, encoding := range encodings {
+			variant, err := sss.openPrecompressed(octx, key, obj, encoding, sss.openObject)
+			if err == nil {
+				file.Close()
+				span.SetAttributes(attribute.String("encoding", encoding))
+				return variant, nil
+			}
+		}
+	}
+	if _, ok := file.(*S3MetaFile); ok {
+		file.Close()
+		if file, err = sss.openObject(octx, key); err != nil {
+			return nil, err
+		}
+	}
+	return sss.compressOnTheFly(octx, file, encodings[0]), nil
+}
+
+// compressOnTheFly returns the cached object compressed with encoding
+// if the backend compresses its type, else the file as it is.
+func (sss *S3BackendImpl) compressOnTheFly(ctx context.Context, file http.File, encoding string) http.File {
+	cached, ok := file.(*S3CachedFile)
+	if !sss.compression.OnTheFly || !ok || cached.obj.ContentEncoding != nil || len(cached.buf) < sss.compressMinSize() {
+		return file
+	}
+	ctype := cached.header.Get("Content-Type")
+	if ctype == "" {
+		ctype = mime.TypeByExtension(path.Ext(cached.name))
+	}
+	if !sss.compressible(ctype) {
+		return file
+	}
+	variant, err := sss.compressed(ctx, cached, encoding)
+	if err != nil {
+		sss.log.Error().Err(err).Str("name", cached.name).Str("encoding", encoding).Msg("compress")
+		return file
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("encoding", encoding))
+	return variant
+}
+
+// encodedMeta negotiates the encoding of a HEAD request like OpenEncoded
+// does, from the metadata alone. An encoding made on the fly is only
+// announced with the size of its cached variant, without one the HEAD
+// describes the object as it is.
+func (sss *S3BackendImpl) encodedMeta(file http.File, encodings []string) http.File {
+	octx, span := sss.tracer.Start(sss.ctx, "encodedMeta")
+	defer span.End()
+
+	key, obj, ok := objectOf(file)
+	if !ok || obj.ContentEncoding != nil {
+		return file
+	}
+	span.AddEvent(key)
+	if sss.compression.Precompressed {
+		for _, encoding := range encodings {
+			variant, err := sss.openPrecompressed(octx, key, obj, encoding, sss.openMeta)
+			if err == nil {
+				file.Close()
+				span.SetAttributes(attribute.String("encoding", encoding))
+				return variant
+			}
+		}
+	}
+	meta, ok := file.(*S3MetaFile)
+	if !ok {
+		// the cached object itself, compressed as for a GET
+		return sss.compressOnTheFly(octx, file, encodings[0])
+	}
+	if !sss.compression.OnTheFly || obj.ContentLength > int64(sss.maxObjectSize) || obj.ContentLength < int64(sss.compressMinSize()) {
+		return file
+	}
+	ctype := meta.header.Get("Content-Type")
+	if ctype == "" {
+		ctype = mime.TypeByExtension(path.Ext(key))
+	}
+	if !sss.compressible(ctype) {
+		return file
+	}
+	encoding := encodings[0]
+	v, _ := sss.cache.Get(sss.cachePrefix + key + "\x00" + encoding)
+	variant, found := v.(S3CachedFile)
+	if !found || aws.ToString(variant.obj.ETag) != aws.ToString(obj.ETag) || int64(len(variant.buf)) >= obj.ContentLength {
+		// not compressed yet or not paying off, the length is unknown
+		return file
+	}
+	meta.header = sss.encodedHeader(key, obj, encoding)
+	meta.encoding = encoding
+	meta.encodedSize = int64(len(variant.buf))
+	span.SetAttributes(attribute.String("encoding", encoding))
+	return meta
+}
+
+func (sss *S3BackendImpl) compressMinSize() int {
+	if sss.compression.MinSize > 0 {
+		return sss.compression.MinSize
+	}
+	return defaultCompressMinSize
+}
+
+// openPrecompressed opens key.br or key.gz with openObject, missing
+// variants are remembered for maxAge so not every request asks S3 for
+// them again.
+func (sss *S3BackendImpl) openPrecompressed(ctx context.Context, key string, obj *s3.GetObjectOutput, encoding string, openObject func(ctx context.Context, key string) (http.File, error)) (http.File, error) {
+	variantKey := key + encodingSuffix(encoding)
+	missingKey := sss.cachePrefix + variantKey + "\x00missing"
+	if _, missing := sss.cache.Get(missingKey); missing {
+		return nil, fs.ErrNotExist
+	}
+	file, err := openObject(ctx, variantKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			sss.cache.SetWithTTL(missingKey, struct{}{}, 1, sss.maxAge)
+		}
+		return nil, err
+	}
+	header := sss.encodedHeader(key, obj, encoding)
+	switch f := file.(type) {
+	case *S3CachedFile:
+		f.header = header
+	case *S3DirectFile:
+		f.header = header
+	case *S3MetaFile:
+		f.header = header
+	}
+	return file, nil
+}
+
+// compressed returns the object compressed with encoding. The variant is
+// cached next to the object and made again once the object has changed.
+func (sss *S3BackendImpl) compressed(ctx context.Context, src *S3CachedFile, encoding string) (http.File, error) {
+	_, span := sss.tracer.Start(ctx, "compressed")
+	defer span.End()
+	span.AddEvent(src.name)
+
+	cacheKey := sss.cachePrefix + src.name + "\x00" + encoding
+	v, _ := sss.cache.Get(cacheKey)
+	if variant, found := v.(S3CachedFile); found {
+		if aws.ToString(variant.obj.ETag) == aws.ToString(src.obj.ETag) {
+			span.SetStatus(otelcodes.Ok, "cache hit")
+			return sss.openVariant(ctx, &variant, src), nil
+		}
+	}
+	buf, err := compress(encoding, src.buf)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("size", len(src.buf)), attribute.Int("compressed", len(buf)))
+	variant := S3CachedFile{
+		log:      src.log.With().Str("encoding", encoding).Logger(),
+		tracer:   sss.tracer,
+		ctx:      ctx,
+		name:     src.name,
+		obj:      src.obj,
+		buf:      buf,
+		fetched:  src.fetched,
+		encoding: encoding,
+	}
+	if !sss.cache.Set(cacheKey, variant, int64(len(buf))) {
+		sss.log.Warn().Str("name", src.name).Msg("cache set failed")
+	}
+	span.SetStatus(otelcodes.Ok, "cache miss")
+	return sss.openVariant(ctx, &variant, src), nil
+}
+
+// openVariant falls back to the object if compressing did not pay off.
+func (sss *S3BackendImpl) openVariant(ctx context.Context, variant, src *S3CachedFile) http.File {
+	if len(variant.buf) >= len(src.buf) {
+		return src
+	}
+	return variant.open(sss.tracer, ctx, sss.encodedHeader(src.name, src.obj, variant.encoding))
+}
@@ -0,0 +1,101 @@
+package s3backend
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/mabels/diener/middleware"
+	"github.com/rs/zerolog"
+)
+
+// TestVaryWithCORS checks that the Vary of a compressed object keeps the
+// Origin the CORS middleware varies on, or a shared cache would hand the
+// response of one origin to another.
+func TestVaryWithCORS(t *testing.T) {
+	_, _, db := newFakeS3Backend(t, 1<<20, map[string]string{"file.txt": strings.Repeat(seekContent, 10)}, func(cfg *ctx.S3BackendConfig) {
+		cfg.Compression = ctx.CompressionConfig{OnTheFly: true, MinSize: 10, Types: []string{"text/*"}}
+	})
+	cors := middleware.NewCORS(zerolog.Nop(), ctx.CORSConfig{AllowOrigins: []string{"https://a.example.com"}})
+	handler := cors.Wrap(NewFileServer(db.WithContext(context.Background()).WithHost("example.com")))
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		t.Run(method, func(t *testing.T) {
+			r := httptest.NewRequest(method, "/file.txt", nil)
+			r.Header.Set("Origin", "https://a.example.com")
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			res := w.Result()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, want 200", res.StatusCode)
+			}
+			if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+				t.Errorf("Content-Encoding %q, want gzip", got)
+			}
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://a.example.com" {
+				t.Errorf("Access-Control-Allow-Origin %q", got)
+			}
+			vary := strings.Join(res.Header.Values("Vary"), ", ")
+			for _, want := range []string{"Origin", "Accept-Encoding"} {
+				if !strings.Contains(vary, want) {
+					t.Errorf("Vary %q misses %s", vary, want)
+				}
+			}
+		})
+	}
+}
+
+// TestHeadEncodedLength checks that HEAD only announces an encoding made
+// on the fly with the length a GET sends.
+func TestHeadEncodedLength(t *testing.T) {
+	content := strings.Repeat(seekContent, 10)
+	_, sss, db := newFakeS3Backend(t, 1<<20, map[string]string{"file.txt": content}, func(cfg *ctx.S3BackendConfig) {
+		cfg.Compression = ctx.CompressionConfig{OnTheFly: true, MinSize: 10, Types: []string{"text/*"}}
+	})
+	head := func() *http.Response {
+		t.Helper()
+		res := serve(db, http.MethodHead, "/file.txt", "Accept-Encoding", "gzip")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("HEAD status %d", res.StatusCode)
+		}
+		return res
+	}
+
+	res := head()
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("HEAD before any GET announces %q", got)
+	}
+	if got := res.Header.Get("Content-Length"); got != strconv.Itoa(len(content)) {
+		t.Errorf("HEAD before any GET has Content-Length %s, want %d", got, len(content))
+	}
+
+	get := serve(db, http.MethodGet, "/file.txt", "Accept-Encoding", "gzip")
+	body, _ := io.ReadAll(get.Body)
+	if get.Header.Get("Content-Encoding") != "gzip" || len(body) >= len(content) {
+		t.Fatalf("GET sent %d bytes with encoding %q", len(body), get.Header.Get("Content-Encoding"))
+	}
+	// only the variant stays cached, the HEAD asks S3 for the metadata
+	sss.cache.Wait()
+	sss.cache.Del(sss.cachePrefix + "file.txt")
+	res = head()
+	if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("HEAD after GET has Content-Encoding %q, want gzip", got)
+	}
+	if got, want := res.Header.Get("Content-Length"), get.Header.Get("Content-Length"); got != want {
+		t.Errorf("HEAD after GET has Content-Length %q, GET %q", got, want)
+	}
+	if got, want := res.Header.Get("ETag"), get.Header.Get("ETag"); got != want {
+		t.Errorf("HEAD ETag %s, GET ETag %s", got, want)
+	}
+	// the entity a range refers to is the encoded one
+	sss.cache.Del(sss.cachePrefix + "file.txt")
+	res = serve(db, http.MethodHead, "/file.txt", "Accept-Encoding", "gzip", "Range", "bytes=0-9")
+	if got, want := res.Header.Get("Content-Range"), "bytes 0-9/"+strconv.Itoa(len(body)); got != want {
+		t.Errorf("HEAD Content-Range %q, want %q", got, want)
+	}
+}
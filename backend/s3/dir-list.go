@@ -0,0 +1,138 @@
+package s3backend
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type dirEntry struct {
+	Name         string     `json:"name"`
+	Dir          bool       `json:"dir"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
+type dirListing struct {
+	Path    string     `json:"path"`
+	Entries []dirEntry `json:"entries"`
+	// Next is the continuation token of the next page, if there is one
+	Next string `json:"next,omitempty"`
+}
+
+// dirListPageSize is the most entries a listing shows, it is the page
+// size of ListObjectsV2.
+const dirListPageSize = 1000
+
+// pagedDir is implemented by directories which are listed page by page,
+// a listing request asks for one page only.
+type pagedDir interface {
+	Page(token string, count int) ([]fs.FileInfo, string, error)
+}
+
+var dirListTemplate = template.Must(template.New("dirlist").Funcs(template.FuncMap{
+	"href": func(e dirEntry) string {
+		u := url.URL{Path: e.Name}
+		if e.Dir {
+			return u.String() + "/"
+		}
+		return u.String()
+	},
+	"nextHref": func(next string) string {
+		return "?" + url.Values{"continuation": {next}}.Encode()
+	},
+}).Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last Modified</th><th>ETag</th></tr>
+{{- range .Entries}}
+<tr><td><a href="{{href .}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+{{- if .Dir}}<td>-</td><td></td><td></td>{{else}}<td>{{.Size}}</td><td>{{.LastModified.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.ETag}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- if .Next}}
+<p><a href="{{nextHref .Next}}">Next page</a></p>
+{{- end}}
+</body>
+</html>
+`))
+
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// readDir reads one page of the directory, the page after the
+// continuation token of the request. Directories which cannot be paged
+// show their first dirListPageSize entries.
+func readDir(r *http.Request, f http.File) ([]fs.FileInfo, string, error) {
+	if pd, ok := f.(pagedDir); ok {
+		return pd.Page(r.URL.Query().Get("continuation"), dirListPageSize)
+	}
+	infos, err := f.Readdir(dirListPageSize)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return infos, "", err
+}
+
+// dirList renders a page of the entries of a directory as HTML or, if
+// the client asks for it, as JSON.
+func (fsrv *FileServer) dirList(w http.ResponseWriter, r *http.Request, name string, f http.File) {
+	infos, next, err := readDir(r, f)
+	if err != nil {
+		fsrv.serveError(w, r, name, err)
+		return
+	}
+	listing := dirListing{Path: r.URL.Path, Entries: make([]dirEntry, 0, len(infos)), Next: next}
+	for _, info := range infos {
+		entry := dirEntry{
+			Name: info.Name(),
+			Dir:  info.IsDir(),
+		}
+		if !entry.Dir {
+			entry.Size = info.Size()
+			modTime := info.ModTime()
+			entry.LastModified = &modTime
+			if et, ok := info.(etagger); ok {
+				entry.ETag = et.ETag()
+			}
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	// the same URL is HTML or JSON, caches must keep both
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(listing)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method != http.MethodHead {
+		dirListTemplate.Execute(w, listing)
+	}
+}
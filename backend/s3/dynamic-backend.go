@@ -2,8 +2,11 @@ package s3backend
 
 import (
 	"context"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/rs/zerolog"
@@ -14,19 +17,121 @@ type FSWithCtx interface {
 	WithContext(ctx context.Context) FSWithCtx
 }
 
+// PathType mirrors the pathType of an Ingress HTTP path.
+type PathType string
+
+const (
+	PathTypeExact                  PathType = "Exact"
+	PathTypePrefix                 PathType = "Prefix"
+	PathTypeImplementationSpecific PathType = "ImplementationSpecific"
+)
+
 type Route struct {
-	Path string
-	FS   FSWithCtx
+	// Ingress is the namespace/name of the Ingress which defined the route.
+	Ingress string
+	// Host is the Ingress rule host, empty matches every host and
+	// a leading "*." matches exactly one additional label.
+	Host     string
+	Path     string
+	PathType PathType
+	// Default marks the catch-all route of an Ingress spec.defaultBackend,
+	// it only serves what no rule route of the same host matches.
+	Default bool
+	FS      FSWithCtx
+	// Handler serves the requests of the route instead of the file
+	// server, like the WebDAV front end.
+	Handler http.Handler
+	// Middlewares wrap the file server for the requests of the route,
+	// the first one sees the request first.
+	Middlewares []func(http.Handler) http.Handler
+}
+
+// match reports if the request path is served by this route.
+// ImplementationSpecific keeps the plain string prefix match diener
+// always did.
+func (r *Route) match(name string) bool {
+	switch r.PathType {
+	case PathTypeExact:
+		return name == r.Path
+	case PathTypePrefix:
+		prefix := strings.TrimSuffix(r.Path, "/")
+		if !strings.HasPrefix(name, prefix) {
+			return false
+		}
+		rest := name[len(prefix):]
+		return rest == "" || rest[0] == '/'
+	default:
+		return strings.HasPrefix(name, r.Path)
+	}
+}
+
+// MountPoint is the part of the request path which the route is mounted
+// on. An Exact route is mounted on its parent directory.
+func (r *Route) MountPoint() string {
+	switch r.PathType {
+	case PathTypeExact:
+		return strings.TrimSuffix(path.Dir(r.Path), "/")
+	case PathTypePrefix:
+		return strings.TrimSuffix(r.Path, "/")
+	default:
+		return r.Path
+	}
+}
+
+// trim strips the mount point of the route from the request path.
+func (r *Route) trim(name string) string {
+	return strings.TrimPrefix(name, r.MountPoint())
+}
+
+func pathTypeOrder(pt PathType) int {
+	switch pt {
+	case PathTypeExact:
+		return 0
+	case PathTypePrefix:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// routeLess orders routes by precedence: the longest path wins, Exact
+// wins over Prefix on equal length. The remaining keys only keep the
+// order stable no matter in which order the informers delivered them.
+func routeLess(a, b *Route) bool {
+	if a.Default != b.Default {
+		return b.Default
+	}
+	if len(a.Path) != len(b.Path) {
+		return len(a.Path) > len(b.Path)
+	}
+	if pathTypeOrder(a.PathType) != pathTypeOrder(b.PathType) {
+		return pathTypeOrder(a.PathType) < pathTypeOrder(b.PathType)
+	}
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	if a.Host != b.Host {
+		return a.Host < b.Host
+	}
+	return a.Ingress < b.Ingress
 }
 
+// DynamicBackend is shared between the informers which add and delete
+// routes and the requests which look them up, WithContext and WithHost
+// copies share the same route table.
 type DynamicBackend struct {
-	routes []Route
+	routes *routeTable
 	log    zerolog.Logger
 	ctx    context.Context
+	host   string
+	// pinned backends serve route, the one resolved once for the request,
+	// no matter how the route table changes meanwhile
+	pinned bool
+	route  *Route
 }
 
 func NewDynamicBackend(log zerolog.Logger) (*DynamicBackend, error) {
-	return &DynamicBackend{log: log}, nil
+	return &DynamicBackend{routes: newRouteTable(), log: log}, nil
 }
 
 func (db *DynamicBackend) WithContext(ctx context.Context) *DynamicBackend {
@@ -35,30 +140,236 @@ func (db *DynamicBackend) WithContext(ctx context.Context) *DynamicBackend {
 	return &cdb
 }
 
-func (db *DynamicBackend) PrependRoute(log zerolog.Logger, route Route) {
-	log.Info().Str("path", route.Path).Msg("prepend route")
-	db.routes = append([]Route{route}, db.routes...)
+// WithHost returns a copy of the backend which resolves routes for the
+// given request host, any port is ignored.
+func (db *DynamicBackend) WithHost(host string) *DynamicBackend {
+	cdb := *db
+	cdb.host = normalizeHost(host)
+	return &cdb
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
 }
 
-func (db *DynamicBackend) DeleteRoute(log zerolog.Logger, path string) *Route {
-	for i, route := range db.routes {
-		if path == route.Path {
-			log.Info().Str("path", path).Msg("delete route")
-			db.routes = append(db.routes[:i], db.routes[i+1:]...)
-			return &route
+const (
+	hostNoMatch = iota - 1
+	hostMatchAny
+	hostMatchWildcard
+	hostMatchExact
+)
+
+// hostMatch ranks how specific a route host matches the request host
+// following the Ingress spec: exact hosts beat wildcards, wildcards
+// beat rules without a host.
+func hostMatch(routeHost, host string) int {
+	switch {
+	case routeHost == "":
+		return hostMatchAny
+	case routeHost == host:
+		return hostMatchExact
+	case strings.HasPrefix(routeHost, "*."):
+		label, rest, found := strings.Cut(host, ".")
+		if found && label != "" && rest == routeHost[2:] {
+			return hostMatchWildcard
 		}
 	}
-	log.Info().Str("path", path).Msg("not found delete route")
+	return hostNoMatch
+}
+
+func normalizeRoute(route Route) Route {
+	route.Host = normalizeHost(route.Host)
+	if route.PathType == "" {
+		route.PathType = PathTypeImplementationSpecific
+	}
+	return route
+}
+
+func (db *DynamicBackend) AddRoute(log zerolog.Logger, route Route) {
+	route = normalizeRoute(route)
+	log.Info().Str("host", route.Host).Str("path", route.Path).Str("pathType", string(route.PathType)).Bool("default", route.Default).Msg("add route")
+	db.routes.add(route)
+}
+
+// ReplaceRoutes swaps all routes of the ingress for the given ones at
+// once, a request is served either by the old or by the new routes and
+// never by whatever else matches in between.
+func (db *DynamicBackend) ReplaceRoutes(log zerolog.Logger, ingress string, routes []Route) {
+	replacement := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		route = normalizeRoute(route)
+		route.Ingress = ingress
+		log.Info().Str("host", route.Host).Str("path", route.Path).Str("pathType", string(route.PathType)).Bool("default", route.Default).Msg("add route")
+		replacement = append(replacement, route)
+	}
+	removed := db.routes.replace(ingress, replacement)
+	log.Info().Str("ingress", ingress).Int("routes", len(replacement)).Int("removed", len(removed)).Msg("replace routes")
+}
+
+// DeleteRoute removes the route with the same Ingress, Host, Path and
+// Default as the given one.
+func (db *DynamicBackend) DeleteRoute(log zerolog.Logger, del Route) *Route {
+	host := normalizeHost(del.Host)
+	route := db.routes.remove(func(route *Route) bool {
+		return del.Ingress == route.Ingress && host == route.Host && del.Path == route.Path && del.Default == route.Default
+	})
+	if route != nil {
+		log.Info().Str("host", host).Str("path", del.Path).Msg("delete route")
+		return route
+	}
+	log.Info().Str("host", host).Str("path", del.Path).Msg("not found delete route")
 	return nil
 }
 
-func (db *DynamicBackend) Open(name string) (http.File, error) {
-	for _, route := range db.routes {
-		if strings.HasPrefix(name, route.Path) {
-			cfs := route.FS.WithContext(db.ctx)
-			return cfs.Open(strings.TrimPrefix(name, route.Path))
+// lookup finds the route serving name for the host of the backend.
+func (db *DynamicBackend) lookup(name string) *Route {
+	if db.pinned {
+		return db.route
+	}
+	routes := db.routes.snapshot()
+	var found *Route
+	// the host decides first, within a host rules beat the default backend
+	best := -1
+	for i, route := range routes {
+		rank := hostMatch(route.Host, db.host)
+		if rank == hostNoMatch {
+			continue
+		}
+		score := 2 * rank
+		if !route.Default {
+			score++
+		}
+		if score <= best || !route.match(name) {
+			continue
+		}
+		found = &routes[i]
+		best = score
+		if score == 2*hostMatchExact+1 {
+			break
 		}
 	}
-	db.log.Warn().Str("name", name).Msg("no route found")
-	return nil, fs.ErrNotExist
+	return found
+}
+
+func (db *DynamicBackend) Open(name string) (http.File, error) {
+	found := db.lookup(name)
+	if found == nil {
+		db.log.Warn().Str("host", db.host).Str("name", name).Msg("no route found")
+		return nil, fs.ErrNotExist
+	}
+	cfs := found.FS.WithContext(db.ctx)
+	return cfs.Open(found.trim(name))
+}
+
+// EncodingFS is implemented by filesystems which serve content encoded
+// variants of their files.
+type EncodingFS interface {
+	OpenEncoded(name string, encodings []string) (http.File, error)
+}
+
+// OpenEncoded opens name in one of the encodings the client accepts if
+// the filesystem of the route supports them, else like Open.
+func (db *DynamicBackend) OpenEncoded(name string, encodings []string) (http.File, error) {
+	found := db.lookup(name)
+	if found == nil {
+		db.log.Warn().Str("host", db.host).Str("name", name).Msg("no route found")
+		return nil, fs.ErrNotExist
+	}
+	cfs := found.FS.WithContext(db.ctx)
+	if efs, ok := cfs.(EncodingFS); ok && len(encodings) > 0 {
+		return efs.OpenEncoded(found.trim(name), encodings)
+	}
+	return cfs.Open(found.trim(name))
+}
+
+// MetaFS is implemented by filesystems which can open a file for its
+// metadata alone, which is all a HEAD request needs. The encodings are
+// negotiated like OpenEncoded does.
+type MetaFS interface {
+	OpenMeta(name string, encodings []string) (http.File, error)
+}
+
+// OpenMeta opens name for its metadata if the filesystem of the route
+// supports it, else like OpenEncoded.
+func (db *DynamicBackend) OpenMeta(name string, encodings []string) (http.File, error) {
+	found := db.lookup(name)
+	if found == nil {
+		db.log.Warn().Str("host", db.host).Str("name", name).Msg("no route found")
+		return nil, fs.ErrNotExist
+	}
+	cfs := found.FS.WithContext(db.ctx)
+	if mfs, ok := cfs.(MetaFS); ok {
+		return mfs.OpenMeta(found.trim(name), encodings)
+	}
+	if efs, ok := cfs.(EncodingFS); ok && len(encodings) > 0 {
+		return efs.OpenEncoded(found.trim(name), encodings)
+	}
+	return cfs.Open(found.trim(name))
+}
+
+// WriteFS is implemented by filesystems which can store and delete
+// files.
+type WriteFS interface {
+	Writable() bool
+	Put(name string, body io.Reader, header http.Header) (string, error)
+	Remove(name string) error
+}
+
+// writable returns the filesystem of the route serving name and the name
+// within it if it accepts writes.
+func (db *DynamicBackend) writable(name string) (WriteFS, string, bool) {
+	found := db.lookup(name)
+	if found == nil {
+		return nil, "", false
+	}
+	wfs, ok := found.FS.WithContext(db.ctx).(WriteFS)
+	if !ok || !wfs.Writable() {
+		return nil, "", false
+	}
+	return wfs, found.trim(name), true
+}
+
+// Handler returns the handler for the request, the file server or the
+// handler of the route serving the request path wrapped in the
+// middlewares of the route. The route is resolved once, the file server
+// serves from the route whose middlewares ran.
+func (db *DynamicBackend) Handler(r *http.Request) http.Handler {
+	found := db.lookup(requestName(r.URL.Path))
+	pdb := *db
+	pdb.pinned = true
+	pdb.route = found
+	var handler http.Handler = NewFileServer(&pdb)
+	if found == nil {
+		return handler
+	}
+	if found.Handler != nil {
+		handler = found.Handler
+	}
+	for i := len(found.Middlewares) - 1; i >= 0; i-- {
+		handler = found.Middlewares[i](handler)
+	}
+	return handler
+}
+
+// ErrorDocumentFS is implemented by filesystems which have their own
+// documents for error responses.
+type ErrorDocumentFS interface {
+	OpenErrorDocument(status int) (http.File, error)
+}
+
+// OpenErrorDocument opens the error document for the status from the
+// filesystem of the route serving name.
+func (db *DynamicBackend) OpenErrorDocument(name string, status int) (http.File, error) {
+	found := db.lookup(name)
+	if found == nil {
+		return nil, fs.ErrNotExist
+	}
+	edfs, ok := found.FS.WithContext(db.ctx).(ErrorDocumentFS)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return edfs.OpenErrorDocument(status)
 }
@@ -0,0 +1,198 @@
+package s3backend
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileServer serves an http.FileSystem like http.FileServer does, but the
+// trailing slash of a directory request is passed on to Open so the
+// filesystem can answer it with its own index document. Errors are
+// answered with the error documents of the route if it has some.
+type FileServer struct {
+	root *DynamicBackend
+}
+
+// etagger is implemented by the fs.FileInfo of files with an entity tag.
+type etagger interface {
+	ETag() string
+}
+
+// headerer is implemented by the fs.FileInfo of files which bring their
+// own response headers.
+type headerer interface {
+	Header() http.Header
+}
+
+const (
+	allowedMethods = "GET, HEAD, OPTIONS"
+	// writeMethods are allowed on routes whose filesystem is writable
+	writeMethods = "PUT, DELETE"
+)
+
+// requestName cleans the request path, keeping the trailing slash of a
+// directory request.
+func requestName(upath string) string {
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := path.Clean(upath)
+	if strings.HasSuffix(upath, "/") && name != "/" {
+		name += "/"
+	}
+	return name
+}
+
+func NewFileServer(root *DynamicBackend) *FileServer {
+	return &FileServer{root: root}
+}
+
+func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := requestName(upath)
+	wfs, wname, writable := fsrv.root.writable(name)
+	allow := allowedMethods
+	if writable {
+		allow += ", " + writeMethods
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPut, http.MethodDelete:
+		if writable {
+			fsrv.write(w, r, wfs, wname)
+			return
+		}
+		fallthrough
+	default:
+		w.Header().Set("Allow", allow)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var f http.File
+	var err error
+	if r.Method == http.MethodHead {
+		// the body is not sent, the metadata is enough
+		f, err = fsrv.root.OpenMeta(name, acceptedEncodings(r))
+	} else {
+		f, err = fsrv.root.OpenEncoded(name, acceptedEncodings(r))
+	}
+	if err != nil {
+		fsrv.serveError(w, r, name, err)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		fsrv.serveError(w, r, name, err)
+		return
+	}
+	if d.IsDir() {
+		if !strings.HasSuffix(upath, "/") {
+			localRedirect(w, r, path.Base(upath)+"/")
+			return
+		}
+		fsrv.dirList(w, r, name, f)
+		return
+	}
+	// with the ETag set http.ServeContent answers If-None-Match and
+	// If-Range, Last-Modified comes from the ModTime
+	if et, ok := d.(etagger); ok && et.ETag() != "" {
+		w.Header().Set("ETag", et.ETag())
+	}
+	// headers stored with the object, a Content-Type keeps
+	// http.ServeContent from guessing. Vary is merged with the one of
+	// the middlewares, a shared cache needs both.
+	if hd, ok := d.(headerer); ok {
+		for key, values := range hd.Header() {
+			if key == "Vary" {
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+				continue
+			}
+			w.Header()[key] = values
+		}
+	}
+	if _, ok := f.(*S3DirectFile); ok {
+		// streaming a large object takes longer than the server timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
+}
+
+// write stores or deletes the file. Uploads may take longer than the
+// server timeouts allow for reading a request, so they are lifted.
+func (fsrv *FileServer) write(w http.ResponseWriter, r *http.Request, wfs WriteFS, name string) {
+	if name == "" || strings.HasSuffix(name, "/") {
+		http.Error(w, "400 cannot write a directory", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := wfs.Remove(name); err != nil {
+			status := errorStatus(err)
+			http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	etag, err := wfs.Put(name, r.Body, r.Header)
+	if err != nil {
+		status := errorStatus(err)
+		http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
+		return
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fsrv *FileServer) serveError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	status := errorStatus(err)
+	doc, derr := fsrv.root.OpenErrorDocument(name, status)
+	if derr != nil {
+		http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
+		return
+	}
+	defer doc.Close()
+	d, derr := doc.Stat()
+	if derr != nil {
+		http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(d.Name()))
+	if ctype == "" {
+		ctype = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.FormatInt(d.Size(), 10))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, doc)
+	}
+}
+
+// localRedirect gives a relative redirect, keeping the query.
+func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
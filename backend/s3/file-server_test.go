@@ -0,0 +1,41 @@
+package s3backend
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// TestStreamPastWriteTimeout downloads an object streamed from S3 which
+// takes longer than the WriteTimeout of the server, from the file server
+// and from WebDAV.
+func TestStreamPastWriteTimeout(t *testing.T) {
+	fake, sss, db := newFakeS3Backend(t, 4, map[string]string{"file.txt": seekContent})
+	fake.slow = 20 * time.Millisecond
+	handlers := map[string]http.Handler{
+		"file server": NewFileServer(db.WithContext(context.Background()).WithHost("example.com")),
+		"webdav":      NewWebDAVHandler(zerolog.Nop(), sss, "/"),
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(handler)
+			srv.Config.WriteTimeout = 100 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+			res, err := http.Get(srv.URL + "/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil || string(body) != seekContent {
+				t.Errorf("got %q, %v, want %q", body, err, seekContent)
+			}
+		})
+	}
+}
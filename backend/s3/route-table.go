@@ -0,0 +1,80 @@
+package s3backend
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// routeTable holds an immutable, sorted snapshot of the routes. Readers
+// load the current snapshot without locking, writers serialize on mu,
+// build a new slice and swap it in. A published slice is never modified.
+type routeTable struct {
+	mu     sync.Mutex
+	routes atomic.Pointer[[]Route]
+}
+
+func newRouteTable() *routeTable {
+	rt := &routeTable{}
+	rt.routes.Store(&[]Route{})
+	return rt
+}
+
+func (rt *routeTable) snapshot() []Route {
+	return *rt.routes.Load()
+}
+
+func (rt *routeTable) add(route Route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	old := rt.snapshot()
+	routes := make([]Route, 0, len(old)+1)
+	routes = append(routes, old...)
+	routes = append(routes, route)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routeLess(&routes[i], &routes[j])
+	})
+	rt.routes.Store(&routes)
+}
+
+// remove deletes the first route for which match returns true and
+// returns it, nil if there was none.
+func (rt *routeTable) remove(match func(*Route) bool) *Route {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	old := rt.snapshot()
+	for i := range old {
+		if match(&old[i]) {
+			removed := old[i]
+			routes := make([]Route, 0, len(old)-1)
+			routes = append(routes, old[:i]...)
+			routes = append(routes, old[i+1:]...)
+			rt.routes.Store(&routes)
+			return &removed
+		}
+	}
+	return nil
+}
+
+// replace swaps all routes of the ingress for the given ones in a single
+// snapshot and returns the routes it removed.
+func (rt *routeTable) replace(ingress string, replacement []Route) []Route {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	old := rt.snapshot()
+	routes := make([]Route, 0, len(old)+len(replacement))
+	removed := []Route{}
+	for _, route := range old {
+		if route.Ingress == ingress {
+			removed = append(removed, route)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	routes = append(routes, replacement...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routeLess(&routes[i], &routes[j])
+	})
+	rt.routes.Store(&routes)
+	return removed
+}
@@ -0,0 +1,163 @@
+package s3backend
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rs/zerolog"
+)
+
+// testFS serves a map of files, it has no use for the context.
+type testFS struct {
+	http.FileSystem
+}
+
+func newTestFS(files map[string]string) *testFS {
+	mfs := fstest.MapFS{}
+	for name, content := range files {
+		mfs[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return &testFS{FileSystem: http.FS(mfs)}
+}
+
+func (tfs *testFS) WithContext(ctx context.Context) FSWithCtx {
+	return tfs
+}
+
+func TestRouteTableOrder(t *testing.T) {
+	rt := newRouteTable()
+	rt.add(Route{Path: "/", PathType: PathTypePrefix, Default: true})
+	rt.add(Route{Path: "/a", PathType: PathTypePrefix})
+	rt.add(Route{Path: "/a/b", PathType: PathTypePrefix})
+	rt.add(Route{Path: "/a", PathType: PathTypeExact})
+	want := []string{"/a/b Prefix", "/a Exact", "/a Prefix", "/ Prefix"}
+	routes := rt.snapshot()
+	if len(routes) != len(want) {
+		t.Fatalf("got %d routes, want %d", len(routes), len(want))
+	}
+	for i, route := range routes {
+		if got := route.Path + " " + string(route.PathType); got != want[i] {
+			t.Errorf("route %d is %q, want %q", i, got, want[i])
+		}
+	}
+	if removed := rt.remove(func(r *Route) bool { return r.Path == "/a" && r.PathType == PathTypeExact }); removed == nil {
+		t.Fatal("exact route not removed")
+	}
+	if removed := rt.remove(func(r *Route) bool { return r.Path == "/missing" }); removed != nil {
+		t.Fatalf("removed %+v which was never added", removed)
+	}
+	if len(rt.snapshot()) != 3 {
+		t.Fatalf("got %d routes after remove, want 3", len(rt.snapshot()))
+	}
+}
+
+// TestRouteTableConcurrent adds and deletes routes while requests look
+// them up, run it with -race. The route of "/stable" is never touched
+// and has to be found by every request.
+func TestRouteTableConcurrent(t *testing.T) {
+	log := zerolog.Nop()
+	db, _ := NewDynamicBackend(log)
+	db.AddRoute(log, Route{
+		Ingress:  "ns/stable",
+		Path:     "/stable",
+		PathType: PathTypePrefix,
+		FS:       newTestFS(map[string]string{"file": "stable"}),
+	})
+	churn := newTestFS(map[string]string{"file": "churn"})
+
+	const writers, readers, rounds = 4, 8, 500
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				route := Route{
+					Ingress:  fmt.Sprintf("ns/churn-%d", w),
+					Path:     fmt.Sprintf("/churn/%d", i%10),
+					PathType: PathTypePrefix,
+					FS:       churn,
+				}
+				db.AddRoute(log, route)
+				db.DeleteRoute(log, route)
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			hdb := db.WithHost("example.com").WithContext(context.Background())
+			for i := 0; i < rounds; i++ {
+				f, err := hdb.Open("/stable/file")
+				if err != nil {
+					errs <- fmt.Errorf("reader %d: open /stable/file: %w", r, err)
+					return
+				}
+				f.Close()
+				if found := hdb.lookup(fmt.Sprintf("/churn/%d/file", i%10)); found != nil && found.FS != churn {
+					errs <- fmt.Errorf("reader %d: churn path served by %s", r, found.Ingress)
+					return
+				}
+				routes := db.routes.snapshot()
+				for j := 1; j < len(routes); j++ {
+					if routeLess(&routes[j], &routes[j-1]) {
+						errs <- fmt.Errorf("reader %d: snapshot not sorted at %d", r, j)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, err := db.Open("/churn/0/file"); err != fs.ErrNotExist {
+		t.Errorf("churn routes left behind, open gave %v", err)
+	}
+}
+
+// TestReplaceRoutesAtomic rebuilds the routes of an ingress while
+// requests look up its protected path, which must never fall through to
+// the catch-all route of another ingress.
+func TestReplaceRoutesAtomic(t *testing.T) {
+	log := zerolog.Nop()
+	db, _ := NewDynamicBackend(log)
+	db.AddRoute(log, Route{Ingress: "ns/public", Path: "/", PathType: PathTypePrefix, Default: true})
+	routes := []Route{
+		{Path: "/protected", PathType: PathTypePrefix},
+		{Path: "/other", PathType: PathTypePrefix},
+	}
+	db.ReplaceRoutes(log, "ns/protected", routes)
+
+	const rounds = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			db.ReplaceRoutes(log, "ns/protected", routes)
+		}
+	}()
+	for i := 0; ; i++ {
+		found := db.lookup("/protected/file")
+		if found == nil || found.Ingress != "ns/protected" {
+			t.Fatalf("lookup %d served by %+v", i, found)
+		}
+		select {
+		case <-done:
+			if n := len(db.routes.snapshot()); n != 3 {
+				t.Fatalf("got %d routes, want 3", n)
+			}
+			return
+		default:
+		}
+	}
+}
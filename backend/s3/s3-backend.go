@@ -3,9 +3,14 @@ package s3backend
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,14 +29,29 @@ import (
 
 type S3BackendImpl struct {
 	bucketName      string
+	cachePrefix     string
 	maxObjectSize   int
 	transferBufSize int
 	maxAge          time.Duration
-	svc             *s3.Client
-	cache           *ristretto.Cache
-	log             zerolog.Logger
-	tracer          trace.Tracer
-	ctx             context.Context
+	indexDocument   string
+	spaFallback     string
+	errorDocuments  map[string]string
+	// directoryListing answers prefix requests with a listing
+	directoryListing bool
+	exposeMetadata   []string
+	// defaultCacheControl is sent for objects without a stored Cache-Control
+	defaultCacheControl   string
+	cacheControlOverrides []cacheControlOverride
+	compression           ctx.CompressionConfig
+	// write accepts PUT and DELETE, the route authorizes them
+	write bool
+	svc   *s3.Client
+	cache *ristretto.Cache
+	// metaCache holds the HeadObject results which answer HEAD requests
+	metaCache *ristretto.Cache
+	log       zerolog.Logger
+	tracer    trace.Tracer
+	ctx       context.Context
 }
 
 func (sss *S3BackendImpl) WithContext(ctx context.Context) FSWithCtx {
@@ -40,7 +60,7 @@ func (sss *S3BackendImpl) WithContext(ctx context.Context) FSWithCtx {
 	return &csss
 }
 
-func NewS3Backend(ctx ctx.AppCtx, cache *ristretto.Cache, s3Cfg ctx.S3BackendConfig) (*S3BackendImpl, error) {
+func NewS3Backend(ctx ctx.AppCtx, cache *ristretto.Cache, metaCache *ristretto.Cache, s3Cfg ctx.S3BackendConfig) (*S3BackendImpl, error) {
 	log := ctx.Log.With().Str("component", "s3-backend").Logger()
 	cfg, err := config.LoadDefaultConfig(ctx.Ctx,
 		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
@@ -61,65 +81,254 @@ func NewS3Backend(ctx ctx.AppCtx, cache *ristretto.Cache, s3Cfg ctx.S3BackendCon
 		maxAge = time.Hour
 	}
 
+	defaultCacheControl := ""
+	if s3Cfg.CacheControl != nil {
+		defaultCacheControl = renderCacheControl(*s3Cfg.CacheControl)
+	}
+	cacheControlOverrides, err := newCacheControlOverrides(s3Cfg.CacheControlOverrides)
+	if err != nil {
+		log.Error().Err(err).Msg("cache control overrides")
+		return nil, err
+	}
+
+	// the object cache is shared by all backends, keep keys of different
+	// buckets apart when several hosts serve the same object names
+	cachePrefix := s3Cfg.BucketName + "/"
+	if s3Cfg.S3.BaseEndpoint != nil {
+		cachePrefix = *s3Cfg.S3.BaseEndpoint + "/" + cachePrefix
+	}
+
 	return &S3BackendImpl{
-		bucketName:      s3Cfg.BucketName,
-		maxObjectSize:   s3Cfg.MaxObjectSize,
-		transferBufSize: s3Cfg.TransferBufSize,
-		maxAge:          maxAge,
-		svc:             svc,
-		cache:           cache,
-		log:             ctx.Log.With().Str("component", "s3-backend").Str("bucket", s3Cfg.BucketName).Logger(),
+		bucketName:            s3Cfg.BucketName,
+		cachePrefix:           cachePrefix,
+		maxObjectSize:         s3Cfg.MaxObjectSize,
+		transferBufSize:       s3Cfg.TransferBufSize,
+		maxAge:                maxAge,
+		indexDocument:         s3Cfg.IndexDocument,
+		spaFallback:           strings.TrimPrefix(s3Cfg.SPAFallback, "/"),
+		errorDocuments:        s3Cfg.ErrorDocuments,
+		directoryListing:      s3Cfg.DirectoryListing,
+		exposeMetadata:        s3Cfg.ExposeMetadata,
+		defaultCacheControl:   defaultCacheControl,
+		cacheControlOverrides: cacheControlOverrides,
+		compression:           s3Cfg.Compression,
+		write:                 s3Cfg.Write,
+		svc:                   svc,
+		cache:                 cache,
+		metaCache:             metaCache,
+		log:                   ctx.Log.With().Str("component", "s3-backend").Str("bucket", s3Cfg.BucketName).Logger(),
 		// span:            trace,
 		tracer: ctx.Tracer,
 		ctx:    ctx.Ctx,
 	}, nil
 }
 
+// errNULKey refuses keys with a NUL. The cache keeps the variants and
+// markers of an object under its key with a NUL appended, request paths
+// must not reach them.
+var errNULKey = &S3Error{Status: http.StatusBadRequest, Err: errors.New("key contains NUL")}
+
+func validKey(key string) bool {
+	return !strings.ContainsRune(key, 0)
+}
+
+// Open maps name to an object key. A name ending in a slash is a
+// directory which is answered with the index document or a listing, a
+// name which is no object but has an index document or keys below it is
+// a directory. Whatever is not found is answered by the SPA fallback
+// object if configured.
 func (sss *S3BackendImpl) Open(name string) (http.File, error) {
-	octx, span := sss.tracer.Start(sss.ctx, "Open")
+	return sss.open(name, "Open", sss.openObject)
+}
+
+// OpenMeta resolves name like OpenEncoded, but the object files returned
+// only carry the metadata from HeadObject, enough to answer HEAD
+// requests with the headers of a GET.
+func (sss *S3BackendImpl) OpenMeta(name string, encodings []string) (http.File, error) {
+	file, err := sss.open(name, "OpenMeta", sss.openMeta)
+	if err != nil || len(encodings) == 0 {
+		return file, err
+	}
+	return sss.encodedMeta(file, encodings), nil
+}
+
+func (sss *S3BackendImpl) open(name string, spanName string, openObject func(ctx context.Context, key string) (http.File, error)) (http.File, error) {
+	octx, span := sss.tracer.Start(sss.ctx, spanName)
+	defer span.End()
+	span.AddEvent(name)
+
+	key := strings.TrimPrefix(name, "/")
+	var err error
+	if key == "" || strings.HasSuffix(key, "/") {
+		err = fs.ErrNotExist
+		if sss.indexDocument != "" {
+			var file http.File
+			file, err = openObject(octx, key+sss.indexDocument)
+			if err == nil {
+				return file, nil
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) && sss.directoryListing && (key == "" || sss.hasPrefix(octx, key)) {
+			return sss.openPrefix(octx, key), nil
+		}
+	} else {
+		var file http.File
+		file, err = openObject(octx, key)
+		if err == nil {
+			return file, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) && sss.isDir(octx, key+"/") {
+			return sss.openPrefix(octx, key+"/"), nil
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) && sss.spaFallback != "" {
+		span.SetAttributes(attribute.String("spaFallback", sss.spaFallback))
+		return openObject(octx, sss.spaFallback)
+	}
+	return nil, err
+}
+
+// OpenErrorDocument opens the error document configured for the status,
+// an exact status like "404" wins over its class like "4xx".
+func (sss *S3BackendImpl) OpenErrorDocument(status int) (http.File, error) {
+	octx, span := sss.tracer.Start(sss.ctx, "OpenErrorDocument")
+	defer span.End()
+	span.SetAttributes(attribute.Int("status", status))
+	key, found := sss.errorDocuments[strconv.Itoa(status)]
+	if !found {
+		key, found = sss.errorDocuments[fmt.Sprintf("%dxx", status/100)]
+	}
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+	return sss.openObject(octx, strings.TrimPrefix(key, "/"))
+}
+
+// responseHeader are the headers sent with the object, the ones stored
+// in S3 with the Cache-Control policy of the backend applied.
+func (sss *S3BackendImpl) responseHeader(key string, obj *s3.GetObjectOutput) http.Header {
+	header := objectHeader(obj, sss.exposeMetadata)
+	if cc := sss.cacheControl(key, header.Get("Cache-Control")); cc != "" {
+		header.Set("Cache-Control", cc)
+	} else {
+		header.Del("Cache-Control")
+	}
+	if sss.compression.Precompressed || sss.compression.OnTheFly {
+		header.Set("Vary", "Accept-Encoding")
+	}
+	return header
+}
+
+// exists asks S3 for the object without fetching it.
+func (sss *S3BackendImpl) exists(ctx context.Context, key string) bool {
+	_, span := sss.tracer.Start(ctx, "exists")
+	defer span.End()
+	span.AddEvent(key)
+	_, err := sss.headObject(ctx, key)
+	if err != nil && !isNotFound(err) {
+		span.SetStatus(otelcodes.Error, err.Error())
+		sss.log.Error().Err(err).Str("name", key).Msg("head object")
+	}
+	return err == nil
+}
+
+// hasPrefix asks S3 if there is any key below the prefix.
+func (sss *S3BackendImpl) hasPrefix(ctx context.Context, prefix string) bool {
+	_, span := sss.tracer.Start(ctx, "hasPrefix")
+	defer span.End()
+	span.AddEvent(prefix)
+	out, err := sss.svc.ListObjectsV2(sss.ctx, &s3.ListObjectsV2Input{
+		Bucket:  &sss.bucketName,
+		Prefix:  aws.String(prefix),
+		MaxKeys: 1,
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		sss.log.Error().Err(err).Str("prefix", prefix).Msg("list objects")
+		return false
+	}
+	return len(out.Contents) > 0
+}
+
+// isDir reports if a request without trailing slash is a directory,
+// which is when it has an index document or can be listed.
+func (sss *S3BackendImpl) isDir(ctx context.Context, prefix string) bool {
+	if sss.indexDocument != "" && sss.exists(ctx, prefix+sss.indexDocument) {
+		return true
+	}
+	return sss.directoryListing && sss.hasPrefix(ctx, prefix)
+}
+
+func (sss *S3BackendImpl) openPrefix(ctx context.Context, prefix string) *S3PrefixFile {
+	return &S3PrefixFile{
+		log:     sss.log.With().Str("prefix", prefix).Logger(),
+		tracer:  sss.tracer,
+		ctx:     ctx,
+		svc:     sss.svc,
+		bucket:  sss.bucketName,
+		prefix:  prefix,
+		listing: sss.directoryListing,
+	}
+}
+
+func (sss *S3BackendImpl) openObject(ctx context.Context, name string) (http.File, error) {
+	octx, span := sss.tracer.Start(ctx, "openObject")
 	defer span.End()
 	span.AddEvent(name)
 
-	name = strings.TrimPrefix(name, "/")
 	log := sss.log.With().Str("name", name).Logger()
-	buf, found := sss.cache.Get(name)
-	if found {
-		age := time.Since(buf.(S3CachedFile).fetched)
-		span.SetAttributes(attribute.Int("size", len(buf.(S3CachedFile).buf)))
+	if !validKey(name) {
+		return nil, errNULKey
+	}
+	cacheKey := sss.cachePrefix + name
+	var stale *S3CachedFile
+	buf, _ := sss.cache.Get(cacheKey)
+	if ifile, found := buf.(S3CachedFile); found {
+		age := time.Since(ifile.fetched)
+		span.SetAttributes(attribute.Int("size", len(ifile.buf)))
 		span.SetAttributes(attribute.Int64("age", int64(age)))
 		if age > sss.maxAge {
 			span.SetStatus(otelcodes.Ok, "cache hit but expired")
 			log.Info().Dur("age", age).Msg("cache hit but expired")
-			sss.cache.Del(name)
-			found = false
+			stale = &ifile
 		} else {
 			span.SetStatus(otelcodes.Ok, "cache hit")
-			log.Info().Int("size", len(buf.(S3CachedFile).buf)).Msg("cache hit")
-			ifile := buf.(S3CachedFile)
-			return &S3CachedFile{
-				log:     ifile.log,
-				tracer:  sss.tracer,
-				ctx:     octx,
-				name:    ifile.name,
-				obj:     ifile.obj,
-				ofs:     0,
-				buf:     ifile.buf,
-				fetched: ifile.fetched,
-			}, nil
+			log.Info().Int("size", len(ifile.buf)).Msg("cache hit")
+			return ifile.open(sss.tracer, octx, sss.responseHeader(name, ifile.obj)), nil
 		}
 	}
 
 	span.SetStatus(otelcodes.Ok, "cache miss")
 	span.SetAttributes(attribute.String("bucket", sss.bucketName))
 	span.SetAttributes(attribute.String("name", name))
-	obj, err := sss.svc.GetObject(sss.ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: &sss.bucketName,
 		Key:    aws.String(name),
-	})
+	}
+	if stale != nil {
+		// revalidate, an unchanged object keeps its cached body
+		input.IfNoneMatch = stale.obj.ETag
+	}
+	obj, err := sss.svc.GetObject(sss.ctx, input)
+	if stale != nil && err != nil && isNotModified(err) {
+		span.SetStatus(otelcodes.Ok, "cache revalidated")
+		log.Info().Msg("cache revalidated")
+		stale.fetched = time.Now()
+		sss.cache.Set(cacheKey, *stale, int64(len(stale.buf)))
+		return stale.open(sss.tracer, octx, sss.responseHeader(name, stale.obj)), nil
+	}
+	if stale != nil {
+		sss.cache.Del(cacheKey)
+	}
 	if err != nil {
 		span.SetStatus(otelcodes.Error, err.Error())
-		log.Error().Err(err).Msg("get object")
-		return nil, fs.ErrNotExist
+		s3Err := toS3Error(err)
+		if s3Err.Status == http.StatusNotFound {
+			log.Info().Msg("object not found")
+		} else {
+			log.Error().Err(err).Int("status", s3Err.Status).Msg("get object")
+		}
+		return nil, s3Err
 	}
 	span.SetAttributes(attribute.Int64("size", obj.ContentLength))
 	if obj.ContentLength > int64(sss.maxObjectSize) {
@@ -129,11 +338,16 @@ func (sss *S3BackendImpl) Open(name string) (http.File, error) {
 			log:     log,
 			tracer:  sss.tracer,
 			ctx:     octx,
+			svc:     sss.svc,
+			bucket:  sss.bucketName,
 			name:    name,
 			obj:     obj,
+			body:    obj.Body,
+			header:  sss.responseHeader(name, obj),
 			fetched: time.Now(),
 		}, nil
 	}
+	defer obj.Body.Close()
 	var fileBuf bytes.Buffer
 	ofs := int64(0)
 	transBuf := make([]byte, sss.transferBufSize)
@@ -177,12 +391,91 @@ func (sss *S3BackendImpl) Open(name string) (http.File, error) {
 		buf:     fileBuf.Bytes(),
 		fetched: time.Now(),
 	}
-	ret := sss.cache.Set(name, s3, int64(len(s3.buf)))
+	ret := sss.cache.Set(cacheKey, s3, int64(len(s3.buf)))
 	if !ret {
 		span.SetStatus(otelcodes.Error, "cache set failed")
 		log.Warn().Msg("cache set failed")
 	}
 	span.SetStatus(otelcodes.Ok, "cache miss")
 	log.Info().Msg("cache miss")
-	return &s3, nil
+	return s3.open(sss.tracer, octx, sss.responseHeader(name, obj)), nil
+}
+
+// headObject asks S3 for the metadata of the object, the answer is kept
+// in the meta cache for maxAge.
+func (sss *S3BackendImpl) headObject(ctx context.Context, key string) (*s3Meta, error) {
+	_, span := sss.tracer.Start(ctx, "headObject")
+	defer span.End()
+	span.AddEvent(key)
+
+	if !validKey(key) {
+		return nil, errNULKey
+	}
+	cacheKey := sss.cachePrefix + key
+	v, _ := sss.metaCache.Get(cacheKey)
+	if meta, found := v.(s3Meta); found {
+		if time.Since(meta.fetched) <= sss.maxAge {
+			span.SetStatus(otelcodes.Ok, "cache hit")
+			return &meta, nil
+		}
+	}
+	head, err := sss.svc.HeadObject(sss.ctx, &s3.HeadObjectInput{
+		Bucket: &sss.bucketName,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		return nil, toS3Error(err)
+	}
+	meta := s3Meta{obj: metaOfHead(head), fetched: time.Now()}
+	if !sss.metaCache.Set(cacheKey, meta, 1) {
+		sss.log.Warn().Str("name", key).Msg("meta cache set failed")
+	}
+	span.SetStatus(otelcodes.Ok, "cache miss")
+	return &meta, nil
+}
+
+// openMeta opens the object without its body. A fresh object in the
+// object cache already has the metadata, else HeadObject is asked.
+func (sss *S3BackendImpl) openMeta(ctx context.Context, name string) (http.File, error) {
+	octx, span := sss.tracer.Start(ctx, "openMeta")
+	defer span.End()
+	span.AddEvent(name)
+
+	log := sss.log.With().Str("name", name).Logger()
+	if !validKey(name) {
+		return nil, errNULKey
+	}
+	buf, _ := sss.cache.Get(sss.cachePrefix + name)
+	if ifile, found := buf.(S3CachedFile); found {
+		if time.Since(ifile.fetched) <= sss.maxAge {
+			span.SetStatus(otelcodes.Ok, "object cache hit")
+			return ifile.open(sss.tracer, octx, sss.responseHeader(name, ifile.obj)), nil
+		}
+	}
+	meta, err := sss.headObject(octx, name)
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Info().Msg("object not found")
+		} else {
+			log.Error().Err(err).Msg("head object")
+		}
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("size", meta.obj.ContentLength))
+	header := sss.responseHeader(name, meta.obj)
+	if header.Get("Content-Type") == "" && mime.TypeByExtension(path.Ext(name)) == "" {
+		// a GET sniffs the type from the body, there is none to sniff
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	return &S3MetaFile{
+		log:     log,
+		tracer:  sss.tracer,
+		ctx:     octx,
+		name:    name,
+		obj:     meta.obj,
+		header:  header,
+		fetched: meta.fetched,
+	}, nil
 }
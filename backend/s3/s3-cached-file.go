@@ -2,9 +2,12 @@ package s3backend
 
 import (
 	"context"
+	"io"
 	"io/fs"
+	"net/http"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
@@ -13,14 +16,30 @@ import (
 )
 
 type S3CachedFile struct {
-	log     zerolog.Logger
-	tracer  trace.Tracer
-	ctx     context.Context
-	name    string
-	obj     *s3.GetObjectOutput
+	log    zerolog.Logger
+	tracer trace.Tracer
+	ctx    context.Context
+	name   string
+	obj    *s3.GetObjectOutput
+	// header are the response headers of the backend opening the object
+	header  http.Header
 	ofs     int64
 	buf     []byte
 	fetched time.Time
+	// encoding is the content encoding of buf if it is a compressed
+	// variant of the object
+	encoding string
+}
+
+// open returns a reader of the cached object starting at offset 0.
+// The cache is shared, the response headers are the ones of the backend
+// opening the object.
+func (s3f S3CachedFile) open(tracer trace.Tracer, ctx context.Context, header http.Header) *S3CachedFile {
+	s3f.tracer = tracer
+	s3f.ctx = ctx
+	s3f.ofs = 0
+	s3f.header = header
+	return &s3f
 }
 
 func (s3f *S3CachedFile) Close() error {
@@ -36,17 +55,13 @@ func (s3f *S3CachedFile) Read(p []byte) (n int, err error) {
 	defer trace.End()
 	trace.AddEvent(s3f.name)
 	trace.SetAttributes(attribute.Int64("ofs", s3f.ofs))
-	// out := bytes.NewBuffer(p)
-	chunk := s3f.obj.ContentLength - s3f.ofs
-	if chunk > int64(len(p)) {
-		chunk = int64(len(p))
+	if s3f.ofs >= int64(len(s3f.buf)) {
+		return 0, io.EOF
 	}
-	copy(p, s3f.buf[s3f.ofs:s3f.ofs+chunk])
-	// fmt.Printf("read: %d:%d:%d\n", s3f.ofs, s3f.buf[s3f.ofs], p[0])
-	s3f.ofs += int64(chunk)
-	trace.SetAttributes(attribute.Int64("len", chunk))
-	return int(chunk), nil
-
+	n = copy(p, s3f.buf[s3f.ofs:])
+	s3f.ofs += int64(n)
+	trace.SetAttributes(attribute.Int("len", n))
+	return n, nil
 }
 
 func (s3f *S3CachedFile) Seek(offset int64, whence int) (int64, error) {
@@ -54,15 +69,16 @@ func (s3f *S3CachedFile) Seek(offset int64, whence int) (int64, error) {
 	defer trace.End()
 	trace.AddEvent(s3f.name)
 	trace.SetAttributes(attribute.Int("whence", whence))
-	if whence == 0 {
-		s3f.log.Debug().Int64("ofs", offset).Msg("seek")
-		trace.SetAttributes(attribute.Int64("ofs", offset))
-		s3f.ofs = offset
-		return s3f.ofs, nil
+	ofs, err := seekOffset(s3f.ofs, int64(len(s3f.buf)), offset, whence)
+	if err != nil {
+		trace.SetStatus(otelcodes.Error, err.Error())
+		s3f.log.Error().Err(err).Int64("offset", offset).Int("whence", whence).Msg("seek")
+		return s3f.ofs, err
 	}
-	trace.SetStatus(otelcodes.Error, "seek not implemented")
-	s3f.log.Error().Int("whence", whence).Msg("seek not implemented")
-	return 0, fs.ErrInvalid
+	s3f.log.Debug().Int64("ofs", ofs).Msg("seek")
+	trace.SetAttributes(attribute.Int64("ofs", ofs))
+	s3f.ofs = ofs
+	return s3f.ofs, nil
 }
 
 func (s3f *S3CachedFile) Readdir(count int) ([]fs.FileInfo, error) {
@@ -84,7 +100,9 @@ func (s3f *S3CachedFile) Stat() (fs.FileInfo, error) {
 		ctx:    octx,
 		tracer: s3f.tracer,
 		log:    s3f.log.With().Str("component", "s3-fileinfo").Logger(),
-		obj:    s3f.obj,
-		time:   s3f.fetched,
+		size:   int64(len(s3f.buf)),
+		etag:   variantETag(aws.ToString(s3f.obj.ETag), s3f.encoding),
+		header: s3f.header,
+		time:   lastModified(s3f.obj, s3f.fetched),
 	}, nil
 }
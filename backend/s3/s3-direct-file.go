@@ -2,9 +2,13 @@ package s3backend
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/fs"
+	"net/http"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
@@ -12,21 +16,62 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// S3DirectFile streams an object too large for the cache straight from
+// S3. After a seek the body is reopened with a ranged GetObject at the
+// new offset, pinned to the ETag of the first response.
 type S3DirectFile struct {
-	log     zerolog.Logger
-	tracer  trace.Tracer
-	ctx     context.Context
-	name    string
-	obj     *s3.GetObjectOutput
+	log    zerolog.Logger
+	tracer trace.Tracer
+	ctx    context.Context
+	svc    *s3.Client
+	bucket string
+	name   string
+	obj    *s3.GetObjectOutput
+	// header are the response headers of the backend opening the object
+	header  http.Header
 	ofs     int64
+	body    io.ReadCloser
+	bodyOfs int64
 	fetched time.Time
 }
 
+func (s3f *S3DirectFile) closeBody() error {
+	if s3f.body == nil {
+		return nil
+	}
+	err := s3f.body.Close()
+	s3f.body = nil
+	return err
+}
+
 func (s3f *S3DirectFile) Close() error {
 	_, trace := s3f.tracer.Start(s3f.ctx, "close")
 	defer trace.End()
 	trace.AddEvent(s3f.name)
 	s3f.log.Debug().Msg("close")
+	return s3f.closeBody()
+}
+
+// reopen requests the object from the current offset on.
+func (s3f *S3DirectFile) reopen() error {
+	_, trace := s3f.tracer.Start(s3f.ctx, "reopen")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	trace.SetAttributes(attribute.Int64("ofs", s3f.ofs))
+	s3f.closeBody()
+	obj, err := s3f.svc.GetObject(s3f.ctx, &s3.GetObjectInput{
+		Bucket:  &s3f.bucket,
+		Key:     aws.String(s3f.name),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-", s3f.ofs)),
+		IfMatch: s3f.obj.ETag,
+	})
+	if err != nil {
+		trace.SetStatus(otelcodes.Error, err.Error())
+		s3f.log.Error().Err(err).Int64("ofs", s3f.ofs).Msg("ranged get object")
+		return toS3Error(err)
+	}
+	s3f.body = obj.Body
+	s3f.bodyOfs = s3f.ofs
 	return nil
 }
 
@@ -35,17 +80,22 @@ func (s3f *S3DirectFile) Read(p []byte) (n int, err error) {
 	defer trace.End()
 	trace.AddEvent(s3f.name)
 	trace.SetAttributes(attribute.Int64("ofs", s3f.ofs))
-	// out := bytes.NewBuffer(p)
-	chunk := s3f.obj.ContentLength - s3f.ofs
-	if chunk > int64(len(p)) {
-		chunk = int64(len(p))
+	if s3f.ofs >= s3f.obj.ContentLength {
+		return 0, io.EOF
 	}
-	// copy(p, s3f.buf[s3f.ofs:s3f.ofs+chunk])
-	// fmt.Printf("read: %d:%d:%d\n", s3f.ofs, s3f.buf[s3f.ofs], p[0])
-	s3f.ofs += int64(chunk)
-	trace.SetAttributes(attribute.Int64("len", chunk))
-	return int(chunk), nil
-
+	if s3f.body == nil || s3f.bodyOfs != s3f.ofs {
+		if err := s3f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = s3f.body.Read(p)
+	s3f.ofs += int64(n)
+	s3f.bodyOfs = s3f.ofs
+	trace.SetAttributes(attribute.Int("len", n))
+	if err == io.EOF && s3f.ofs < s3f.obj.ContentLength {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
 func (s3f *S3DirectFile) Seek(offset int64, whence int) (int64, error) {
@@ -53,15 +103,16 @@ func (s3f *S3DirectFile) Seek(offset int64, whence int) (int64, error) {
 	defer trace.End()
 	trace.AddEvent(s3f.name)
 	trace.SetAttributes(attribute.Int("whence", whence))
-	if whence == 0 {
-		s3f.log.Debug().Int64("ofs", offset).Msg("seek")
-		trace.SetAttributes(attribute.Int64("ofs", offset))
-		s3f.ofs = offset
-		return s3f.ofs, nil
+	ofs, err := seekOffset(s3f.ofs, s3f.obj.ContentLength, offset, whence)
+	if err != nil {
+		trace.SetStatus(otelcodes.Error, err.Error())
+		s3f.log.Error().Err(err).Int64("offset", offset).Int("whence", whence).Msg("seek")
+		return s3f.ofs, err
 	}
-	trace.SetStatus(otelcodes.Error, "seek not implemented")
-	s3f.log.Error().Int("whence", whence).Msg("seek not implemented")
-	return 0, fs.ErrInvalid
+	s3f.log.Debug().Int64("ofs", ofs).Msg("seek")
+	trace.SetAttributes(attribute.Int64("ofs", ofs))
+	s3f.ofs = ofs
+	return s3f.ofs, nil
 }
 
 func (s3f *S3DirectFile) Readdir(count int) ([]fs.FileInfo, error) {
@@ -83,7 +134,9 @@ func (s3f *S3DirectFile) Stat() (fs.FileInfo, error) {
 		ctx:    octx,
 		tracer: s3f.tracer,
 		log:    s3f.log.With().Str("component", "s3-fileinfo").Logger(),
-		obj:    s3f.obj,
-		time:   s3f.fetched,
+		size:   s3f.obj.ContentLength,
+		etag:   aws.ToString(s3f.obj.ETag),
+		header: s3f.header,
+		time:   lastModified(s3f.obj, s3f.fetched),
 	}, nil
 }
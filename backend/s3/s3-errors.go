@@ -0,0 +1,111 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3Error carries the HTTP status an S3 failure is answered with.
+// 404 and 403 are also fs.ErrNotExist and fs.ErrPermission.
+type S3Error struct {
+	Status int
+	Err    error
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("%d %s: %v", e.Status, http.StatusText(e.Status), e.Err)
+}
+
+func (e *S3Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *S3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Status == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.Status == http.StatusForbidden
+	}
+	return false
+}
+
+// isNotFound reports a missing object, GetObject answers with NoSuchKey
+// while HeadObject has no body and only tells NotFound or a bare 404.
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var respErr *awshttp.ResponseError
+	switch {
+	case errors.As(err, &noSuchKey), errors.As(err, &notFound):
+		return true
+	case errors.As(err, &respErr):
+		return respErr.HTTPStatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+// isNotModified reports the answer to a conditional GetObject whose
+// IfNoneMatch still matches.
+func isNotModified(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// toS3Error maps the error of an S3 call to the status diener answers
+// with. Everything S3 does not explain is a bad gateway.
+func toS3Error(err error) *S3Error {
+	status := http.StatusBadGateway
+	var apiErr smithy.APIError
+	var respErr *awshttp.ResponseError
+	var netErr net.Error
+	switch {
+	case isNotFound(err):
+		status = http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		status = http.StatusGatewayTimeout
+	case errors.As(err, &apiErr):
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "AllAccessDisabled", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			status = http.StatusForbidden
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests":
+			status = http.StatusServiceUnavailable
+		case "RequestTimeout":
+			status = http.StatusGatewayTimeout
+		default:
+			if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden {
+				status = http.StatusForbidden
+			}
+		}
+	case errors.As(err, &respErr):
+		switch respErr.HTTPStatusCode() {
+		case http.StatusForbidden:
+			status = http.StatusForbidden
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			status = http.StatusServiceUnavailable
+		}
+	}
+	return &S3Error{Status: status, Err: err}
+}
+
+// errorStatus is the HTTP status for an error of http.FileSystem.Open.
+func errorStatus(err error) int {
+	var s3Err *S3Error
+	switch {
+	case errors.As(err, &s3Err):
+		return s3Err.Status
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -2,21 +2,90 @@ package s3backend
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/fs"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// seekOffset computes the new offset of an io.Seeker for a file of the
+// given size. Seeking past the end is allowed, reading there gives io.EOF.
+func seekOffset(current, size, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += size
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d: %w", whence, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative position %d: %w", offset, fs.ErrInvalid)
+	}
+	return offset, nil
+}
+
+// lastModified is the LastModified of the object, the time it was
+// fetched if S3 did not report one.
+func lastModified(obj *s3.GetObjectOutput, fetched time.Time) time.Time {
+	if obj.LastModified != nil {
+		return *obj.LastModified
+	}
+	return fetched
+}
+
+// objectHeader collects the response headers stored with the object.
+// The generic octet-stream types S3 defaults to are left out so the type
+// is guessed from the name, user metadata is only passed if its key is in
+// expose, "*" exposes all keys.
+func objectHeader(obj *s3.GetObjectOutput, expose []string) http.Header {
+	header := http.Header{}
+	switch ctype := aws.ToString(obj.ContentType); ctype {
+	case "", "binary/octet-stream", "application/octet-stream":
+	default:
+		header.Set("Content-Type", ctype)
+	}
+	if obj.ContentEncoding != nil {
+		header.Set("Content-Encoding", *obj.ContentEncoding)
+	}
+	if obj.ContentDisposition != nil {
+		header.Set("Content-Disposition", *obj.ContentDisposition)
+	}
+	if obj.ContentLanguage != nil {
+		header.Set("Content-Language", *obj.ContentLanguage)
+	}
+	if obj.CacheControl != nil {
+		header.Set("Cache-Control", *obj.CacheControl)
+	}
+	for key, value := range obj.Metadata {
+		for _, allowed := range expose {
+			if allowed == "*" || strings.EqualFold(allowed, key) {
+				header.Set("X-Amz-Meta-"+key, value)
+				break
+			}
+		}
+	}
+	return header
+}
+
 type S3FileInfo struct {
 	log    zerolog.Logger
 	tracer trace.Tracer
 	ctx    context.Context
 	name   string
-	obj    *s3.GetObjectOutput
+	size   int64
+	etag   string
+	header http.Header
+	isDir  bool
 	time   time.Time
 }
 
@@ -31,15 +100,18 @@ func (s3fi *S3FileInfo) Size() int64 {
 	_, trace := s3fi.tracer.Start(s3fi.ctx, "Size")
 	defer trace.End()
 	trace.AddEvent(s3fi.name)
-	trace.SetAttributes(attribute.Int64("size", int64(s3fi.obj.ContentLength)))
-	s3fi.log.Debug().Int("size", int(s3fi.obj.ContentLength)).Msg("size")
-	return s3fi.obj.ContentLength
+	trace.SetAttributes(attribute.Int64("size", s3fi.size))
+	s3fi.log.Debug().Int64("size", s3fi.size).Msg("size")
+	return s3fi.size
 }
 func (s3fi *S3FileInfo) Mode() fs.FileMode {
 	_, trace := s3fi.tracer.Start(s3fi.ctx, "Mode")
 	defer trace.End()
 	trace.AddEvent(s3fi.name)
 	s3fi.log.Debug().Msg("mode")
+	if s3fi.isDir {
+		return fs.ModeDir | 0700
+	}
 	return 0600
 }
 func (s3fi *S3FileInfo) ModTime() time.Time {
@@ -54,7 +126,7 @@ func (s3fi *S3FileInfo) IsDir() bool {
 	defer trace.End()
 	trace.AddEvent(s3fi.name)
 	s3fi.log.Debug().Msg("isdir")
-	return false
+	return s3fi.isDir
 }
 func (s3fi *S3FileInfo) Sys() any {
 	_, trace := s3fi.tracer.Start(s3fi.ctx, "Sys")
@@ -64,3 +136,21 @@ func (s3fi *S3FileInfo) Sys() any {
 	return nil
 
 }
+
+// ETag is the entity tag S3 reported for the object, quotes included.
+func (s3fi *S3FileInfo) ETag() string {
+	_, trace := s3fi.tracer.Start(s3fi.ctx, "ETag")
+	defer trace.End()
+	trace.AddEvent(s3fi.name)
+	s3fi.log.Debug().Msg("etag")
+	return s3fi.etag
+}
+
+// Header are the response headers stored with the object.
+func (s3fi *S3FileInfo) Header() http.Header {
+	_, trace := s3fi.tracer.Start(s3fi.ctx, "Header")
+	defer trace.End()
+	trace.AddEvent(s3fi.name)
+	s3fi.log.Debug().Msg("header")
+	return s3fi.header
+}
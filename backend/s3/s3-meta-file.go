@@ -0,0 +1,124 @@
+package s3backend
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// s3Meta is the metadata of an object as kept in the meta cache.
+type s3Meta struct {
+	obj     *s3.GetObjectOutput
+	fetched time.Time
+}
+
+// metaOfHead keeps the metadata of a HeadObject as GetObjectOutput
+// without body, so headers and file info are made the same way as for
+// the object itself.
+func metaOfHead(head *s3.HeadObjectOutput) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentLength:      head.ContentLength,
+		ContentType:        head.ContentType,
+		ETag:               head.ETag,
+		LastModified:       head.LastModified,
+		Metadata:           head.Metadata,
+	}
+}
+
+// S3MetaFile answers HEAD requests, it knows the size and headers of an
+// object but has no body.
+type S3MetaFile struct {
+	log    zerolog.Logger
+	tracer trace.Tracer
+	ctx    context.Context
+	name   string
+	obj    *s3.GetObjectOutput
+	// header are the response headers of the backend opening the object
+	header  http.Header
+	ofs     int64
+	fetched time.Time
+	// encoding is the content encoding of the cached variant the object
+	// is compressed to on the fly, encodedSize its size
+	encoding    string
+	encodedSize int64
+}
+
+// size is the size of the body a GET would send.
+func (s3f *S3MetaFile) size() int64 {
+	if s3f.encoding != "" {
+		return s3f.encodedSize
+	}
+	return s3f.obj.ContentLength
+}
+
+func (s3f *S3MetaFile) Close() error {
+	_, trace := s3f.tracer.Start(s3f.ctx, "close")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	s3f.log.Debug().Msg("close")
+	return nil
+}
+
+// Read has no body to give, http.ServeContent does not read for HEAD
+// requests as long as it does not have to sniff the content type.
+func (s3f *S3MetaFile) Read(p []byte) (n int, err error) {
+	_, trace := s3f.tracer.Start(s3f.ctx, "read")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	return 0, io.EOF
+}
+
+func (s3f *S3MetaFile) Seek(offset int64, whence int) (int64, error) {
+	_, trace := s3f.tracer.Start(s3f.ctx, "seek")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	trace.SetAttributes(attribute.Int("whence", whence))
+	ofs, err := seekOffset(s3f.ofs, s3f.size(), offset, whence)
+	if err != nil {
+		trace.SetStatus(otelcodes.Error, err.Error())
+		s3f.log.Error().Err(err).Int64("offset", offset).Int("whence", whence).Msg("seek")
+		return s3f.ofs, err
+	}
+	trace.SetAttributes(attribute.Int64("ofs", ofs))
+	s3f.ofs = ofs
+	return s3f.ofs, nil
+}
+
+func (s3f *S3MetaFile) Readdir(count int) ([]fs.FileInfo, error) {
+	_, trace := s3f.tracer.Start(s3f.ctx, "readdir")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	trace.SetAttributes(attribute.Int("count", count))
+	s3f.log.Debug().Int("count", count).Msg("readdir")
+	return nil, nil
+}
+
+func (s3f *S3MetaFile) Stat() (fs.FileInfo, error) {
+	octx, trace := s3f.tracer.Start(s3f.ctx, "stat")
+	defer trace.End()
+	trace.AddEvent(s3f.name)
+	s3f.log.Debug().Msg("stat")
+	return &S3FileInfo{
+		name:   s3f.name,
+		ctx:    octx,
+		tracer: s3f.tracer,
+		log:    s3f.log.With().Str("component", "s3-fileinfo").Logger(),
+		size:   s3f.size(),
+		etag:   variantETag(aws.ToString(s3f.obj.ETag), s3f.encoding),
+		header: s3f.header,
+		time:   lastModified(s3f.obj, s3f.fetched),
+	}, nil
+}
@@ -0,0 +1,170 @@
+package s3backend
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// S3PrefixFile is the directory of all keys starting with prefix, its
+// entries are listed with ListObjectsV2 if listing is enabled.
+type S3PrefixFile struct {
+	log     zerolog.Logger
+	tracer  trace.Tracer
+	ctx     context.Context
+	svc     *s3.Client
+	bucket  string
+	prefix  string
+	listing bool
+	token   *string
+	done    bool
+	pending []fs.FileInfo
+}
+
+func (s3p *S3PrefixFile) Close() error {
+	_, trace := s3p.tracer.Start(s3p.ctx, "close")
+	defer trace.End()
+	trace.AddEvent(s3p.prefix)
+	s3p.log.Debug().Msg("close")
+	return nil
+}
+
+func (s3p *S3PrefixFile) Read(p []byte) (n int, err error) {
+	return 0, fs.ErrInvalid
+}
+
+func (s3p *S3PrefixFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+// nextPage fetches the next page of the listing into pending.
+func (s3p *S3PrefixFile) nextPage(maxKeys int) error {
+	octx, trace := s3p.tracer.Start(s3p.ctx, "listObjects")
+	defer trace.End()
+	trace.AddEvent(s3p.prefix)
+	input := &s3.ListObjectsV2Input{
+		Bucket:            &s3p.bucket,
+		Prefix:            aws.String(s3p.prefix),
+		Delimiter:         aws.String("/"),
+		ContinuationToken: s3p.token,
+	}
+	if maxKeys > 0 {
+		input.MaxKeys = int32(maxKeys)
+	}
+	out, err := s3p.svc.ListObjectsV2(s3p.ctx, input)
+	if err != nil {
+		trace.SetStatus(otelcodes.Error, err.Error())
+		s3p.log.Error().Err(err).Msg("list objects")
+		return toS3Error(err)
+	}
+	for _, cp := range out.CommonPrefixes {
+		name := strings.TrimPrefix(aws.ToString(cp.Prefix), s3p.prefix)
+		s3p.pending = append(s3p.pending, &S3FileInfo{
+			name:   strings.TrimSuffix(name, "/"),
+			ctx:    octx,
+			tracer: s3p.tracer,
+			log:    s3p.log.With().Str("component", "s3-fileinfo").Logger(),
+			isDir:  true,
+		})
+	}
+	for _, obj := range out.Contents {
+		name := strings.TrimPrefix(aws.ToString(obj.Key), s3p.prefix)
+		if name == "" {
+			// the folder placeholder object of some S3 clients
+			continue
+		}
+		s3p.pending = append(s3p.pending, &S3FileInfo{
+			name:   path.Base(name),
+			ctx:    octx,
+			tracer: s3p.tracer,
+			log:    s3p.log.With().Str("component", "s3-fileinfo").Logger(),
+			size:   obj.Size,
+			etag:   aws.ToString(obj.ETag),
+			time:   aws.ToTime(obj.LastModified),
+		})
+	}
+	trace.SetAttributes(attribute.Int("entries", len(out.CommonPrefixes)+len(out.Contents)))
+	s3p.token = out.NextContinuationToken
+	s3p.done = !out.IsTruncated || s3p.token == nil
+	return nil
+}
+
+// Readdir follows http.File, count > 0 returns up to count entries and
+// io.EOF at the end, otherwise all remaining entries are returned.
+func (s3p *S3PrefixFile) Readdir(count int) ([]fs.FileInfo, error) {
+	_, trace := s3p.tracer.Start(s3p.ctx, "readdir")
+	defer trace.End()
+	trace.AddEvent(s3p.prefix)
+	trace.SetAttributes(attribute.Int("count", count))
+	s3p.log.Debug().Int("count", count).Msg("readdir")
+	if !s3p.listing {
+		return nil, fs.ErrPermission
+	}
+	for !s3p.done && (count <= 0 || len(s3p.pending) < count) {
+		if err := s3p.nextPage(count - len(s3p.pending)); err != nil {
+			return nil, err
+		}
+	}
+	n := count
+	if n <= 0 || n > len(s3p.pending) {
+		n = len(s3p.pending)
+	}
+	entries := s3p.pending[:n]
+	s3p.pending = s3p.pending[n:]
+	if len(entries) == 0 && count > 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// Page lists up to count entries starting at the continuation token of a
+// previous page, "" starts at the first entry. The returned token is ""
+// after the last page.
+func (s3p *S3PrefixFile) Page(token string, count int) ([]fs.FileInfo, string, error) {
+	_, trace := s3p.tracer.Start(s3p.ctx, "page")
+	defer trace.End()
+	trace.AddEvent(s3p.prefix)
+	trace.SetAttributes(attribute.Int("count", count))
+	if !s3p.listing {
+		return nil, "", fs.ErrPermission
+	}
+	s3p.token = nil
+	if token != "" {
+		s3p.token = aws.String(token)
+	}
+	s3p.pending = nil
+	if err := s3p.nextPage(count); err != nil {
+		return nil, "", err
+	}
+	entries := s3p.pending
+	s3p.pending = nil
+	if s3p.done {
+		return entries, "", nil
+	}
+	return entries, aws.ToString(s3p.token), nil
+}
+
+func (s3p *S3PrefixFile) Stat() (fs.FileInfo, error) {
+	octx, trace := s3p.tracer.Start(s3p.ctx, "stat")
+	defer trace.End()
+	trace.AddEvent(s3p.prefix)
+	s3p.log.Debug().Msg("stat")
+	return &S3FileInfo{
+		name:   s3p.prefix,
+		ctx:    octx,
+		tracer: s3p.tracer,
+		log:    s3p.log.With().Str("component", "s3-fileinfo").Logger(),
+		isDir:  true,
+		time:   time.Now(),
+	}, nil
+}
@@ -0,0 +1,364 @@
+package s3backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dgraph-io/ristretto"
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+)
+
+// fakeS3 answers GetObject and HeadObject of a path style bucket, open
+// ranges "bytes=N-" as the S3DirectFile asks for them included. With
+// slow set a body is sent one byte per slow. Multipart uploads are
+// counted and their parts thrown away.
+type fakeS3 struct {
+	objects map[string]string
+	gets    int
+	slow    time.Duration
+	uploads int
+	parts   int
+	aborts  int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploads++
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>`, key, f.uploads)
+		return
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		io.Copy(io.Discard, r.Body)
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, f.parts))
+		return
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.aborts++
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, found := f.objects[key]
+	if !found {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+		return
+	}
+	etag := `"etag-` + key + `"`
+	if im := r.Header.Get("If-Match"); im != "" && im != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Last-Modified", "Mon, 02 Jan 2023 03:04:05 GMT")
+	if r.Method == http.MethodGet {
+		f.gets++
+	}
+	status := http.StatusOK
+	var start int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+		body = body[start:]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if f.slow == 0 {
+		io.WriteString(w, body)
+		return
+	}
+	for i := range body {
+		w.Write([]byte{body[i]})
+		w.(http.Flusher).Flush()
+		time.Sleep(f.slow)
+	}
+}
+
+// newFakeS3Backend serves the objects with a file server, objects larger
+// than maxObjectSize are streamed by S3DirectFile. The options change the
+// config of the backend.
+func newFakeS3Backend(t *testing.T, maxObjectSize int, objects map[string]string, options ...func(*ctx.S3BackendConfig)) (*fakeS3, *S3BackendImpl, *DynamicBackend) {
+	t.Helper()
+	f := &fakeS3{objects: objects}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1000, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaCache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1000, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appCtx := ctx.AppCtx{
+		Log:    zerolog.Nop(),
+		Tracer: otel.Tracer("test"),
+		Meter:  otel.Meter("test"),
+		Ctx:    context.Background(),
+	}
+	cfg := ctx.S3BackendConfig{
+		BucketName:      "bucket",
+		MaxObjectSize:   maxObjectSize,
+		TransferBufSize: 4,
+		Credentials:     aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret"},
+		S3: s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Region:       "us-east-1",
+		},
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+	sss, err := NewS3Backend(appCtx, cache, metaCache, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := NewDynamicBackend(zerolog.Nop())
+	db.AddRoute(zerolog.Nop(), Route{Ingress: "ns/test", Path: "/", PathType: PathTypePrefix, FS: sss})
+	return f, sss, db
+}
+
+func serve(db *DynamicBackend, method, target string, header ...string) *http.Response {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	NewFileServer(db.WithContext(context.Background()).WithHost(r.Host)).ServeHTTP(w, r)
+	return w.Result()
+}
+
+const seekContent = "0123456789abcdefghij"
+
+// seekBackends are the two kinds of files a range request is served
+// from, the cached and the streamed one.
+var seekBackends = []struct {
+	name          string
+	maxObjectSize int
+}{
+	{"cached", 1 << 20},
+	{"direct", 4},
+}
+
+func TestRangeRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []string
+		status  int
+		body    string
+		ranges  []string
+		ctRange string
+	}{
+		{
+			name:   "full",
+			status: http.StatusOK,
+			body:   seekContent,
+		},
+		{
+			name:    "range",
+			header:  []string{"Range", "bytes=2-5"},
+			status:  http.StatusPartialContent,
+			body:    "2345",
+			ctRange: "bytes 2-5/20",
+		},
+		{
+			name:    "open range",
+			header:  []string{"Range", "bytes=15-"},
+			status:  http.StatusPartialContent,
+			body:    "fghij",
+			ctRange: "bytes 15-19/20",
+		},
+		{
+			name:    "suffix range",
+			header:  []string{"Range", "bytes=-3"},
+			status:  http.StatusPartialContent,
+			body:    "hij",
+			ctRange: "bytes 17-19/20",
+		},
+		{
+			name:   "multi range",
+			header: []string{"Range", "bytes=0-1,10-12,-2"},
+			status: http.StatusPartialContent,
+			ranges: []string{"01", "abc", "ij"},
+		},
+		{
+			name:    "if-range matches",
+			header:  []string{"Range", "bytes=4-6", "If-Range", `"etag-file.txt"`},
+			status:  http.StatusPartialContent,
+			body:    "456",
+			ctRange: "bytes 4-6/20",
+		},
+		{
+			name:   "if-range outdated",
+			header: []string{"Range", "bytes=4-6", "If-Range", `"etag-old"`},
+			status: http.StatusOK,
+			body:   seekContent,
+		},
+		{
+			name:    "unsatisfiable",
+			header:  []string{"Range", "bytes=20-30"},
+			status:  http.StatusRequestedRangeNotSatisfiable,
+			ctRange: "bytes */20",
+		},
+		{
+			name:   "invalid",
+			header: []string{"Range", "bytes=5-2"},
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for _, backend := range seekBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			_, _, db := newFakeS3Backend(t, backend.maxObjectSize, map[string]string{"file.txt": seekContent})
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					res := serve(db, http.MethodGet, "/file.txt", tt.header...)
+					defer res.Body.Close()
+					if res.StatusCode != tt.status {
+						t.Fatalf("status %d, want %d", res.StatusCode, tt.status)
+					}
+					if got := res.Header.Get("Content-Range"); got != tt.ctRange {
+						t.Errorf("Content-Range %q, want %q", got, tt.ctRange)
+					}
+					if tt.ranges != nil {
+						checkMultipart(t, res, tt.ranges)
+						return
+					}
+					if tt.status == http.StatusRequestedRangeNotSatisfiable {
+						return
+					}
+					body, _ := io.ReadAll(res.Body)
+					if string(body) != tt.body {
+						t.Errorf("body %q, want %q", body, tt.body)
+					}
+				})
+			}
+		})
+	}
+}
+
+func checkMultipart(t *testing.T, res *http.Response, want []string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q, want multipart/byteranges", res.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for i, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != w {
+			t.Errorf("part %d is %q, want %q", i, body, w)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("more parts than %d", len(want))
+	}
+}
+
+func TestSeek(t *testing.T) {
+	steps := []struct {
+		offset int64
+		whence int
+		pos    int64
+		read   string
+		fails  bool
+	}{
+		{offset: 3, whence: io.SeekStart, pos: 3, read: "34"},
+		{offset: 2, whence: io.SeekCurrent, pos: 7, read: "78"},
+		{offset: -4, whence: io.SeekCurrent, pos: 5, read: "56"},
+		{offset: -2, whence: io.SeekEnd, pos: 18, read: "ij"},
+		{offset: 0, whence: io.SeekEnd, pos: 20},
+		{offset: 5, whence: io.SeekEnd, pos: 25},
+		{offset: -21, whence: io.SeekEnd, fails: true},
+		{offset: 0, whence: 42, fails: true},
+	}
+	for _, backend := range seekBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			_, sss, _ := newFakeS3Backend(t, backend.maxObjectSize, map[string]string{"file.txt": seekContent})
+			f, err := sss.Open("/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, step := range steps {
+				before, _ := f.Seek(0, io.SeekCurrent)
+				pos, err := f.Seek(step.offset, step.whence)
+				if step.fails {
+					if err == nil {
+						t.Errorf("seek(%d, %d) gave no error", step.offset, step.whence)
+					}
+					if pos != before {
+						t.Errorf("failed seek(%d, %d) moved to %d", step.offset, step.whence, pos)
+					}
+					continue
+				}
+				if err != nil || pos != step.pos {
+					t.Fatalf("seek(%d, %d) = %d, %v, want %d", step.offset, step.whence, pos, err, step.pos)
+				}
+				buf := make([]byte, 2)
+				n, err := io.ReadFull(f, buf)
+				if step.read == "" {
+					if n != 0 || err != io.EOF {
+						t.Errorf("read at %d gave %d bytes, %v, want EOF", pos, n, err)
+					}
+					continue
+				}
+				if err != nil || string(buf[:n]) != step.read {
+					t.Errorf("read at %d gave %q, %v, want %q", pos, buf[:n], err, step.read)
+				}
+			}
+		})
+	}
+}
+
+// TestDirectFileReopens checks that the streamed file only asks S3 again
+// after a seek away from where its body stands.
+func TestDirectFileReopens(t *testing.T) {
+	f, sss, _ := newFakeS3Backend(t, 4, map[string]string{"file.txt": seekContent})
+	file, err := sss.Open("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, ok := file.(*S3DirectFile); !ok {
+		t.Fatalf("opened %T, want *S3DirectFile", file)
+	}
+	buf := make([]byte, 5)
+	io.ReadFull(file, buf)
+	file.Seek(0, io.SeekCurrent)
+	io.ReadFull(file, buf)
+	if f.gets != 1 {
+		t.Errorf("%d GetObjects for sequential reads, want 1", f.gets)
+	}
+	file.Seek(-3, io.SeekEnd)
+	n, _ := io.ReadFull(file, buf)
+	if string(buf[:n]) != "hij" {
+		t.Errorf("read %q after seek from end, want %q", buf[:n], "hij")
+	}
+	if f.gets != 2 {
+		t.Errorf("%d GetObjects after a seek, want 2", f.gets)
+	}
+}
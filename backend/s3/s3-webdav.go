@@ -0,0 +1,505 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVWriteMethods are the WebDAV methods which change the bucket,
+// they are refused unless the backend is writable.
+var WebDAVWriteMethods = []string{
+	http.MethodPut,
+	http.MethodDelete,
+	"MKCOL",
+	"COPY",
+	"MOVE",
+	"PROPPATCH",
+	"LOCK",
+	"UNLOCK",
+}
+
+const webDAVReadMethods = "GET, HEAD, OPTIONS, PROPFIND"
+
+// NewWebDAVHandler serves the backend as WebDAV below prefix, the mount
+// point of its route. Collections are key prefixes, MKCOL stores an
+// empty "prefix/" object so empty collections survive.
+func NewWebDAVHandler(log zerolog.Logger, sss *S3BackendImpl, prefix string) http.Handler {
+	log = log.With().Str("component", "webdav").Str("bucket", sss.bucketName).Logger()
+	dav := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: &S3WebDAVFS{backend: sss},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Warn().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("webdav")
+			}
+		},
+	}
+	writes := map[string]bool{}
+	for _, method := range WebDAVWriteMethods {
+		writes[method] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// webdav.Handler serves POST like GET, but the read methods the
+		// route authorizes are GET, HEAD and PROPFIND
+		if r.Method == http.MethodPost || writes[r.Method] && !sss.Writable() {
+			allow := webDAVReadMethods
+			if sss.Writable() {
+				allow += ", " + strings.Join(WebDAVWriteMethods, ", ")
+			}
+			w.Header().Set("Allow", allow)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodGet {
+			// large objects stream longer than the server timeout allows
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+		if r.Method == http.MethodPut {
+			// uploads take as long as they take
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+			// the handler closes the upload even if copying the body
+			// failed, the upload tells by the body it read
+			body := &bodyReader{r: r.Body}
+			r = r.WithContext(context.WithValue(r.Context(), davBodyKey{}, body))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// davBodyKey keeps the bodyReader of a PUT request in its context.
+type davBodyKey struct{}
+
+// S3WebDAVFS maps the webdav.FileSystem onto the bucket and keeps the
+// cache of the backend coherent with what it changes.
+type S3WebDAVFS struct {
+	backend *S3BackendImpl
+}
+
+// with is the backend tracing within the context of the request.
+func (dfs *S3WebDAVFS) with(ctx context.Context) *S3BackendImpl {
+	return dfs.backend.WithContext(ctx).(*S3BackendImpl)
+}
+
+// davError is err as the plain fs error the WebDAV handler tells apart
+// with os.IsNotExist and the like, which do not unwrap.
+func davError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fs.ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		return fs.ErrPermission
+	}
+	return err
+}
+
+// davKey is the object key of a WebDAV name, "" is the bucket root.
+func davKey(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// davFileInfo names files by their base name as WebDAV expects and knows
+// their content type and ETag, so the handler neither sniffs the body nor
+// makes up an ETag.
+type davFileInfo struct {
+	*S3FileInfo
+	base string
+}
+
+func (sss *S3BackendImpl) davInfo(ctx context.Context, key string, fi S3FileInfo) *davFileInfo {
+	fi.ctx = ctx
+	fi.tracer = sss.tracer
+	fi.log = sss.log.With().Str("component", "s3-fileinfo").Logger()
+	fi.name = key
+	base := path.Base(key)
+	if key == "" {
+		base = "/"
+	}
+	return &davFileInfo{S3FileInfo: &fi, base: base}
+}
+
+func (fi *davFileInfo) Name() string {
+	return fi.base
+}
+
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := fi.header.Get("Content-Type"); ctype != "" {
+		return ctype, nil
+	}
+	if ctype := mime.TypeByExtension(path.Ext(fi.base)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.etag, nil
+}
+
+func (dfs *S3WebDAVFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	sss := dfs.with(ctx)
+	octx, span := sss.tracer.Start(ctx, "davStat")
+	defer span.End()
+	span.AddEvent(name)
+
+	key := davKey(name)
+	if key == "" {
+		return sss.davInfo(octx, key, S3FileInfo{isDir: true, time: time.Now()}), nil
+	}
+	meta, err := sss.headObject(octx, key)
+	if err == nil {
+		return sss.davInfo(octx, key, S3FileInfo{
+			size:   meta.obj.ContentLength,
+			etag:   aws.ToString(meta.obj.ETag),
+			header: sss.responseHeader(key, meta.obj),
+			time:   lastModified(meta.obj, meta.fetched),
+		}), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		span.SetStatus(otelcodes.Error, err.Error())
+		return nil, davError(err)
+	}
+	if sss.hasPrefix(octx, key+"/") {
+		return sss.davInfo(octx, key, S3FileInfo{isDir: true, time: time.Now()}), nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// OpenFile opens objects and collections for reading, every write flag
+// opens an upload which replaces the object on Close.
+func (dfs *S3WebDAVFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	sss := dfs.with(ctx)
+	octx, span := sss.tracer.Start(ctx, "davOpenFile")
+	defer span.End()
+	span.AddEvent(name)
+	span.SetAttributes(attribute.Int("flag", flag))
+
+	key := davKey(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if key == "" || flag&os.O_APPEND != 0 {
+			return nil, fs.ErrInvalid
+		}
+		return sss.davUpload(octx, key), nil
+	}
+	if key == "" {
+		return sss.davDir(octx, key), nil
+	}
+	file, err := sss.openObject(octx, key)
+	if err == nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, davError(err)
+		}
+		if s3fi, ok := info.(*S3FileInfo); ok {
+			info = &davFileInfo{S3FileInfo: s3fi, base: path.Base(key)}
+		}
+		return &davFile{File: file, info: info}, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) && sss.hasPrefix(octx, key+"/") {
+		return sss.davDir(octx, key), nil
+	}
+	span.SetStatus(otelcodes.Error, err.Error())
+	return nil, davError(err)
+}
+
+func (sss *S3BackendImpl) davDir(ctx context.Context, key string) webdav.File {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	dir := sss.openPrefix(ctx, prefix)
+	// WebDAV clients browse by listing, no matter the directoryListing
+	dir.listing = true
+	return &davFile{File: dir, info: sss.davInfo(ctx, key, S3FileInfo{isDir: true, time: time.Now()})}
+}
+
+// davFile is a read only file of the backend as webdav.File.
+type davFile struct {
+	http.File
+	info os.FileInfo
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, fs.ErrPermission
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	for i, info := range infos {
+		if s3fi, ok := info.(*S3FileInfo); ok {
+			infos[i] = &davFileInfo{S3FileInfo: s3fi, base: s3fi.name}
+		}
+	}
+	return infos, err
+}
+
+// davUpload streams what the WebDAV handler writes into Put, the upload
+// runs while the body is copied and Close waits for its end. If reading
+// the request body failed Close aborts the upload.
+type davUpload struct {
+	sss  *S3BackendImpl
+	ctx  context.Context
+	key  string
+	body *bodyReader
+	pw   *io.PipeWriter
+	size int64
+	done chan putResult
+	etag string
+}
+
+type putResult struct {
+	etag string
+	err  error
+}
+
+func (sss *S3BackendImpl) davUpload(ctx context.Context, key string) *davUpload {
+	pr, pw := io.Pipe()
+	body, _ := ctx.Value(davBodyKey{}).(*bodyReader)
+	upload := &davUpload{sss: sss, ctx: ctx, key: key, body: body, pw: pw, done: make(chan putResult, 1)}
+	go func() {
+		etag, err := sss.Put(key, pr, nil)
+		// a failed upload fails the writes still to come
+		pr.CloseWithError(err)
+		upload.done <- putResult{etag, err}
+	}()
+	return upload
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	n, err := u.pw.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *davUpload) Close() error {
+	if u.done == nil {
+		return fs.ErrClosed
+	}
+	if u.body != nil && u.body.err != nil {
+		u.pw.CloseWithError(u.body.err)
+	} else {
+		u.pw.Close()
+	}
+	result := <-u.done
+	u.done = nil
+	u.etag = result.etag
+	return result.err
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	return 0, fs.ErrPermission
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fs.ErrInvalid
+}
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return u.sss.davInfo(u.ctx, u.key, S3FileInfo{size: u.size, etag: u.etag, time: time.Now()}), nil
+}
+
+// Mkdir stores the empty "name/" object, its parent has to exist.
+func (dfs *S3WebDAVFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	sss := dfs.with(ctx)
+	octx, span := sss.tracer.Start(ctx, "davMkdir")
+	defer span.End()
+	span.AddEvent(name)
+
+	key := davKey(name)
+	if key == "" {
+		return fs.ErrExist
+	}
+	if _, err := dfs.Stat(octx, key); err == nil {
+		return fs.ErrExist
+	}
+	if parent := path.Dir(key); parent != "." {
+		info, err := dfs.Stat(octx, parent)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fs.ErrNotExist
+		}
+	}
+	_, err := sss.Put(key+"/", http.NoBody, nil)
+	return davError(err)
+}
+
+// RemoveAll deletes the object and every key below it.
+func (dfs *S3WebDAVFS) RemoveAll(ctx context.Context, name string) error {
+	sss := dfs.with(ctx)
+	octx, span := sss.tracer.Start(ctx, "davRemoveAll")
+	defer span.End()
+	span.AddEvent(name)
+
+	key := davKey(name)
+	if key == "" {
+		// the bucket itself stays
+		return fs.ErrPermission
+	}
+	if err := sss.Remove(key); err != nil {
+		return davError(err)
+	}
+	return davError(sss.eachKey(octx, key+"/", func(keys []string) error {
+		return sss.deleteKeys(octx, keys)
+	}))
+}
+
+// Rename copies the object or every key below the collection to the new
+// name and deletes the originals, S3 has no rename.
+func (dfs *S3WebDAVFS) Rename(ctx context.Context, oldName, newName string) error {
+	sss := dfs.with(ctx)
+	octx, span := sss.tracer.Start(ctx, "davRename")
+	defer span.End()
+	span.AddEvent(oldName)
+	span.SetAttributes(attribute.String("newName", newName))
+
+	oldKey, newKey := davKey(oldName), davKey(newName)
+	if oldKey == "" || newKey == "" || strings.HasPrefix(newKey+"/", oldKey+"/") {
+		return fs.ErrInvalid
+	}
+	if sss.exists(octx, oldKey) {
+		if err := sss.copyObject(octx, oldKey, newKey); err != nil {
+			return davError(err)
+		}
+		return davError(sss.Remove(oldKey))
+	}
+	found := false
+	err := sss.eachKey(octx, oldKey+"/", func(keys []string) error {
+		found = true
+		for _, key := range keys {
+			if err := sss.copyObject(octx, key, newKey+strings.TrimPrefix(key, oldKey)); err != nil {
+				return err
+			}
+		}
+		return sss.deleteKeys(octx, keys)
+	})
+	if err == nil && !found {
+		return fs.ErrNotExist
+	}
+	return davError(err)
+}
+
+// eachKey calls fn with every page of keys below the prefix.
+func (sss *S3BackendImpl) eachKey(ctx context.Context, prefix string, fn func(keys []string) error) error {
+	_, span := sss.tracer.Start(ctx, "eachKey")
+	defer span.End()
+	span.AddEvent(prefix)
+
+	var token *string
+	for {
+		out, err := sss.svc.ListObjectsV2(sss.ctx, &s3.ListObjectsV2Input{
+			Bucket:            &sss.bucketName,
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+			sss.log.Error().Err(err).Str("prefix", prefix).Msg("list objects")
+			return toS3Error(err)
+		}
+		keys := make([]string, 0, len(out.Contents))
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		token = out.NextContinuationToken
+		if !out.IsTruncated || token == nil {
+			return nil
+		}
+	}
+}
+
+// deleteKeys deletes up to 1000 keys, the page size of a listing, with a
+// single DeleteObjects.
+func (sss *S3BackendImpl) deleteKeys(ctx context.Context, keys []string) error {
+	_, span := sss.tracer.Start(ctx, "deleteKeys")
+	defer span.End()
+	span.SetAttributes(attribute.Int("keys", len(keys)))
+
+	objects := make([]types.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		defer sss.invalidate(key)
+	}
+	out, err := sss.svc.DeleteObjects(sss.ctx, &s3.DeleteObjectsInput{
+		Bucket: &sss.bucketName,
+		Delete: &types.Delete{Objects: objects, Quiet: true},
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		sss.log.Error().Err(err).Int("keys", len(keys)).Msg("delete objects")
+		return toS3Error(err)
+	}
+	if len(out.Errors) > 0 {
+		e := out.Errors[0]
+		span.SetStatus(otelcodes.Error, aws.ToString(e.Message))
+		sss.log.Error().Str("name", aws.ToString(e.Key)).Str("code", aws.ToString(e.Code)).Int("errors", len(out.Errors)).Msg("delete objects")
+		return &S3Error{Status: http.StatusInternalServerError, Err: errors.New(aws.ToString(e.Message))}
+	}
+	sss.log.Info().Int("keys", len(keys)).Msg("delete objects")
+	return nil
+}
+
+// copyObject copies within the bucket, stored headers and metadata are
+// copied along.
+func (sss *S3BackendImpl) copyObject(ctx context.Context, src, dst string) error {
+	_, span := sss.tracer.Start(ctx, "copyObject")
+	defer span.End()
+	span.AddEvent(src)
+	span.SetAttributes(attribute.String("dst", dst))
+
+	defer sss.invalidate(dst)
+	source := (&url.URL{Path: sss.bucketName + "/" + src}).EscapedPath()
+	_, err := sss.svc.CopyObject(sss.ctx, &s3.CopyObjectInput{
+		Bucket:     &sss.bucketName,
+		Key:        aws.String(dst),
+		CopySource: aws.String(source),
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		sss.log.Error().Err(err).Str("name", src).Str("dst", dst).Msg("copy object")
+		return toS3Error(err)
+	}
+	sss.log.Info().Str("name", src).Str("dst", dst).Msg("copy object")
+	return nil
+}
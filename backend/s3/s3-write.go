@@ -0,0 +1,246 @@
+package s3backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+)
+
+// uploadPartSize is the size of the parts of a multipart upload, bodies
+// up to this size are stored with a single PutObject.
+const uploadPartSize = 8 << 20
+
+// abortTimeout bounds aborting a multipart upload, which has to happen
+// even if the request is gone already.
+const abortTimeout = 30 * time.Second
+
+// putHeaders are the request headers stored with a written object.
+type putHeaders struct {
+	contentType        *string
+	contentEncoding    *string
+	contentDisposition *string
+	contentLanguage    *string
+	cacheControl       *string
+}
+
+func newPutHeaders(key string, header http.Header) putHeaders {
+	get := func(name string) *string {
+		if v := header.Get(name); v != "" {
+			return aws.String(v)
+		}
+		return nil
+	}
+	ph := putHeaders{
+		contentType:        get("Content-Type"),
+		contentEncoding:    get("Content-Encoding"),
+		contentDisposition: get("Content-Disposition"),
+		contentLanguage:    get("Content-Language"),
+		cacheControl:       get("Cache-Control"),
+	}
+	if ph.contentType == nil {
+		if ctype := mime.TypeByExtension(path.Ext(key)); ctype != "" {
+			ph.contentType = aws.String(ctype)
+		}
+	}
+	return ph
+}
+
+// bodyError is a failure reading the request body, the client's fault.
+func bodyError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return &S3Error{Status: http.StatusRequestEntityTooLarge, Err: err}
+	}
+	return &S3Error{Status: http.StatusBadRequest, Err: err}
+}
+
+// bodyReader keeps the error of the request body. io.ReadFull gives
+// io.ErrUnexpectedEOF for a short last part, which is also what a body
+// cut off by the client fails with, only the body tells them apart.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
+
+// Writable reports if the backend accepts PUT and DELETE.
+func (sss *S3BackendImpl) Writable() bool {
+	return sss.write
+}
+
+// Put streams the body into the object, bodies larger than one part
+// become a multipart upload. Returns the ETag of the new object.
+func (sss *S3BackendImpl) Put(name string, body io.Reader, header http.Header) (string, error) {
+	octx, span := sss.tracer.Start(sss.ctx, "Put")
+	defer span.End()
+	span.AddEvent(name)
+
+	key := strings.TrimPrefix(name, "/")
+	log := sss.log.With().Str("name", key).Logger()
+	if !validKey(key) {
+		return "", errNULKey
+	}
+	defer sss.invalidate(key)
+	ph := newPutHeaders(key, header)
+	br := &bodyReader{r: body}
+	part := make([]byte, uploadPartSize)
+	n, err := io.ReadFull(br, part)
+	if br.err != nil {
+		span.SetStatus(otelcodes.Error, br.err.Error())
+		log.Warn().Err(br.err).Msg("read body")
+		return "", bodyError(br.err)
+	}
+	if err != nil {
+		// the body ended within the first part
+		span.SetAttributes(attribute.Int("size", n))
+		out, err := sss.svc.PutObject(sss.ctx, &s3.PutObjectInput{
+			Bucket:             &sss.bucketName,
+			Key:                aws.String(key),
+			Body:               bytes.NewReader(part[:n]),
+			ContentLength:      int64(n),
+			ContentType:        ph.contentType,
+			ContentEncoding:    ph.contentEncoding,
+			ContentDisposition: ph.contentDisposition,
+			ContentLanguage:    ph.contentLanguage,
+			CacheControl:       ph.cacheControl,
+		})
+		if err != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+			log.Error().Err(err).Msg("put object")
+			return "", toS3Error(err)
+		}
+		log.Info().Int("size", n).Msg("put object")
+		return aws.ToString(out.ETag), nil
+	}
+	return sss.putMultipart(octx, key, part, br, ph)
+}
+
+// putMultipart uploads the body part by part, part is the already read
+// first one. A failed upload or body is aborted so no parts are left
+// behind and no truncated object is stored.
+func (sss *S3BackendImpl) putMultipart(ctx context.Context, key string, part []byte, body *bodyReader, ph putHeaders) (string, error) {
+	_, span := sss.tracer.Start(ctx, "putMultipart")
+	defer span.End()
+	span.AddEvent(key)
+
+	log := sss.log.With().Str("name", key).Logger()
+	upload, err := sss.svc.CreateMultipartUpload(sss.ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             &sss.bucketName,
+		Key:                aws.String(key),
+		ContentType:        ph.contentType,
+		ContentEncoding:    ph.contentEncoding,
+		ContentDisposition: ph.contentDisposition,
+		ContentLanguage:    ph.contentLanguage,
+		CacheControl:       ph.cacheControl,
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		log.Error().Err(err).Msg("create multipart upload")
+		return "", toS3Error(err)
+	}
+	abort := func(err error) (string, error) {
+		span.SetStatus(otelcodes.Error, err.Error())
+		// a client hanging up cancels the request context, the parts
+		// would stay in the bucket
+		actx, cancel := context.WithTimeout(context.WithoutCancel(sss.ctx), abortTimeout)
+		defer cancel()
+		_, aerr := sss.svc.AbortMultipartUpload(actx, &s3.AbortMultipartUploadInput{
+			Bucket:   &sss.bucketName,
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		if aerr != nil {
+			log.Error().Err(aerr).Msg("abort multipart upload")
+		}
+		return "", err
+	}
+	completed := []types.CompletedPart{}
+	size := int64(0)
+	n := len(part)
+	for num := int32(1); n > 0; num++ {
+		out, err := sss.svc.UploadPart(sss.ctx, &s3.UploadPartInput{
+			Bucket:        &sss.bucketName,
+			Key:           aws.String(key),
+			UploadId:      upload.UploadId,
+			PartNumber:    num,
+			Body:          bytes.NewReader(part[:n]),
+			ContentLength: int64(n),
+		})
+		if err != nil {
+			log.Error().Err(err).Int32("part", num).Msg("upload part")
+			return abort(toS3Error(err))
+		}
+		completed = append(completed, types.CompletedPart{ETag: out.ETag, PartNumber: num})
+		size += int64(n)
+		n, _ = io.ReadFull(body, part)
+		if body.err != nil {
+			log.Warn().Err(body.err).Msg("read body")
+			return abort(bodyError(body.err))
+		}
+	}
+	span.SetAttributes(attribute.Int64("size", size), attribute.Int("parts", len(completed)))
+	out, err := sss.svc.CompleteMultipartUpload(sss.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &sss.bucketName,
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("complete multipart upload")
+		return abort(toS3Error(err))
+	}
+	log.Info().Int64("size", size).Int("parts", len(completed)).Msg("put multipart object")
+	return aws.ToString(out.ETag), nil
+}
+
+// Remove deletes the object, deleting a missing object is no error.
+func (sss *S3BackendImpl) Remove(name string) error {
+	_, span := sss.tracer.Start(sss.ctx, "Remove")
+	defer span.End()
+	span.AddEvent(name)
+
+	key := strings.TrimPrefix(name, "/")
+	defer sss.invalidate(key)
+	_, err := sss.svc.DeleteObject(sss.ctx, &s3.DeleteObjectInput{
+		Bucket: &sss.bucketName,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		sss.log.Error().Err(err).Str("name", key).Msg("delete object")
+		return toS3Error(err)
+	}
+	sss.log.Info().Str("name", key).Msg("delete object")
+	return nil
+}
+
+// invalidate drops everything cached about the key: the object, its
+// compressed variants, a missing marker and its metadata.
+func (sss *S3BackendImpl) invalidate(key string) {
+	cacheKey := sss.cachePrefix + key
+	sss.cache.Del(cacheKey)
+	sss.cache.Del(cacheKey + "\x00missing")
+	for _, e := range encodingExt {
+		sss.cache.Del(cacheKey + "\x00" + e.encoding)
+	}
+	sss.metaCache.Del(cacheKey)
+}
@@ -0,0 +1,49 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// cutBody ends with an error after n bytes, cancelling the request
+// context first like a client hanging up does.
+type cutBody struct {
+	n      int
+	cancel context.CancelFunc
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.n == 0 {
+		b.cancel()
+		return 0, errors.New("connection reset by peer")
+	}
+	if len(p) > b.n {
+		p = p[:b.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	b.n -= len(p)
+	return len(p), nil
+}
+
+// TestPutAbortsCutBody checks that a multipart upload whose client went
+// away is aborted, although the request context is cancelled by then.
+func TestPutAbortsCutBody(t *testing.T) {
+	f, sss, _ := newFakeS3Backend(t, 1<<20, map[string]string{})
+	rctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &cutBody{n: uploadPartSize + 1, cancel: cancel}
+	_, err := sss.WithContext(rctx).(*S3BackendImpl).Put("/big.bin", body, http.Header{})
+	if errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("put gave %v, want a 400", err)
+	}
+	if f.uploads != 1 || f.parts != 1 {
+		t.Errorf("%d uploads with %d parts, want 1 with 1", f.uploads, f.parts)
+	}
+	if f.aborts != 1 {
+		t.Errorf("%d aborts, want 1", f.aborts)
+	}
+}
@@ -17,18 +17,133 @@ type S3BackendConfig struct {
 	MaxObjectSize   int
 	MaxAgeSeconds   int
 	TransferBufSize int
-	Credentials     aws.Credentials
-	S3              s3.Options
+	// IndexDocument is served for directory requests, e.g. index.html
+	IndexDocument string
+	// SPAFallback is the key served for every object which does not exist
+	SPAFallback string
+	// ErrorDocuments maps a status like "404" or a class like "5xx" to a key
+	ErrorDocuments map[string]string
+	// DirectoryListing answers prefix requests with a listing of the keys
+	DirectoryListing bool
+	// ExposeMetadata are the x-amz-meta-* keys passed to responses, "*" for all
+	ExposeMetadata []string
+	// CacheControl is the Cache-Control of objects without one stored in S3
+	CacheControl *CacheControl
+	// CacheControlOverrides win over the stored and default Cache-Control,
+	// the first matching pattern applies
+	CacheControlOverrides []CacheControlOverride
+	// Compression serves gzip and brotli encoded objects
+	Compression CompressionConfig
+	// Write accepts PUT and DELETE of objects, authorizing them is up to
+	// the route
+	Write       bool
+	Credentials aws.Credentials
+	S3          s3.Options
+}
+
+// CacheControl is a caching policy for browsers and shared caches
+type CacheControl struct {
+	MaxAgeSeconds  *int
+	SMaxAgeSeconds *int
+	Immutable      bool
+	NoCache        bool
+	NoStore        bool
+}
+
+// CacheControlOverride applies a CacheControl to the keys matching Pattern:
+// "*.html" matches the base name, "/assets/*" everything below assets/
+type CacheControlOverride struct {
+	Pattern string
+	CacheControl
+}
+
+// CompressionConfig enables content negotiation of gzip and brotli
+type CompressionConfig struct {
+	// Precompressed serves key.br or key.gz if they exist
+	Precompressed bool
+	// OnTheFly compresses cached objects of the Types and caches the result
+	OnTheFly bool
+	// MinSize is the size below which nothing is compressed on the fly
+	MinSize int
+	// Types are the compressible content types, "text/*" for all text types
+	Types []string
+}
+
+// CORSConfig is a CORS policy, origins are exact, "*" or wildcard
+// subdomains like "https://*.example.com"
+type CORSConfig struct {
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+	MaxAgeSeconds    int
+}
+
+// JWTConfig validates the bearer JWTs of the requests of a route against
+// the keys of a JWKS, given as JWKS or fetched from JWKSURL.
+type JWTConfig struct {
+	Issuer   string
+	Audience string
+	JWKSURL  string
+	JWKS     []byte
+	// Prefixes limit the keys a token may read, no rules allow all keys
+	Prefixes []JWTPrefixRule
+}
+
+// JWTPrefixRule allows the prefixes to tokens whose claim has the value,
+// any value if Value is empty. "{value}" in a prefix is replaced by the
+// value of the claim.
+type JWTPrefixRule struct {
+	Claim    string
+	Value    string
+	Prefixes []string
+}
+
+// IPFilterConfig limits a route to clients of the Allow networks, if
+// any, which are not in the Deny networks. Entries are CIDRs or IPs.
+type IPFilterConfig struct {
+	Allow []string
+	Deny  []string
+}
+
+// RateLimitConfig is a token bucket per key, Key is "ip", "route" or
+// "header:<name>".
+type RateLimitConfig struct {
+	RequestsPerSecond float64
+	Burst             int
+	Key               string
 }
 
 type HttpConfig struct {
-	Listen string
+	Listen    string
+	ListenTLS string
+	// TrustedProxies are the CIDRs of the proxies whose ForwardedHeader
+	// tells the client IP
+	TrustedProxies []string
+	// ForwardedHeader is the header the trusted proxies write,
+	// "x-forwarded-for" or "forwarded"
+	ForwardedHeader string
+}
+
+type IngressConfig struct {
+	// ControllerName is the spec.controller of the IngressClasses diener serves
+	ControllerName string
+	// PublishService is the namespace/name of the Service whose address is
+	// written into the status of the served Ingresses
+	PublishService string
+	// PublishStatusAddresses are static IPs or hostnames for the Ingress status
+	PublishStatusAddresses []string
 }
 
 type Config struct {
-	Ristretto  ristretto.Config
-	S3Backends []S3BackendConfig
-	HttpConfig HttpConfig
+	Ristretto ristretto.Config
+	// MetaRistretto configures the cache of object metadata, the cost of
+	// an entry is 1
+	MetaRistretto ristretto.Config
+	S3Backends    []S3BackendConfig
+	HttpConfig    HttpConfig
+	Ingress       IngressConfig
 	// NumCounters: 1e10,    // number of keys to track frequency of (10M).
 	// MaxCost:     1 << 30, // maximum cost of cache (1GB).
 	// BufferItems: 64,      // number of keys per Get buffer.
@@ -12,14 +12,105 @@ import (
 )
 
 type S3BackendSpec struct {
-	AccessKey       string  `json:"accessKey"`
-	BucketName      string  `json:"bucketName"`
-	Endpoint        *string `json:"endpoint,omitempty"`
-	MaxAgeSeconds   int     `json:"maxAgeSeconds"`
-	MaxObjectSize   int     `json:"maxObjectSize"`
-	Region          *string `json:"region,omitempty"`
-	SecretKey       string  `json:"secretKey"`
-	TransferBufSize int     `json:"transferBufSize"`
+	AccessKey        string            `json:"accessKey"`
+	BucketName       string            `json:"bucketName"`
+	CacheControl     *CacheControlSpec `json:"cacheControl,omitempty"`
+	Compression      *CompressionSpec  `json:"compression,omitempty"`
+	CORS             *CORSSpec         `json:"cors,omitempty"`
+	DirectoryListing bool              `json:"directoryListing,omitempty"`
+	Endpoint         *string           `json:"endpoint,omitempty"`
+	ErrorDocuments   map[string]string `json:"errorDocuments,omitempty"`
+	ExposeMetadata   []string          `json:"exposeMetadata,omitempty"`
+	IndexDocument    *string           `json:"indexDocument,omitempty"`
+	IPFilter         *IPFilterSpec     `json:"ipFilter,omitempty"`
+	JWT              *JWTSpec          `json:"jwt,omitempty"`
+	MaxAgeSeconds    int               `json:"maxAgeSeconds"`
+	MaxObjectSize    int               `json:"maxObjectSize"`
+	Region           *string           `json:"region,omitempty"`
+	SecretKey        string            `json:"secretKey"`
+	SignedURLs       *SignedURLSpec    `json:"signedURLs,omitempty"`
+	SPAFallback      *string           `json:"spaFallback,omitempty"`
+	TransferBufSize  int               `json:"transferBufSize"`
+	WebDAV           bool              `json:"webdav,omitempty"`
+	Write            *WriteSpec        `json:"write,omitempty"`
+}
+
+// CacheControlPolicy is rendered into the Cache-Control response header.
+type CacheControlPolicy struct {
+	Immutable bool `json:"immutable,omitempty"`
+	MaxAge    *int `json:"maxAge,omitempty"`
+	NoCache   bool `json:"noCache,omitempty"`
+	NoStore   bool `json:"noStore,omitempty"`
+	SMaxAge   *int `json:"sMaxAge,omitempty"`
+}
+
+// CacheControlOverride applies its policy to the keys matching Pattern.
+type CacheControlOverride struct {
+	Pattern            string `json:"pattern"`
+	CacheControlPolicy `json:",inline"`
+}
+
+// CacheControlSpec is the default policy of a backend and its overrides.
+type CacheControlSpec struct {
+	CacheControlPolicy `json:",inline"`
+	Overrides          []CacheControlOverride `json:"overrides,omitempty"`
+}
+
+// CompressionSpec enables gzip and brotli encoded responses.
+type CompressionSpec struct {
+	MinSize       int      `json:"minSize,omitempty"`
+	OnTheFly      bool     `json:"onTheFly,omitempty"`
+	Precompressed bool     `json:"precompressed,omitempty"`
+	Types         []string `json:"types,omitempty"`
+}
+
+// CORSSpec is the CORS policy of the routes served by the backend.
+type CORSSpec struct {
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	AllowHeaders     []string `json:"allowHeaders,omitempty"`
+	AllowMethods     []string `json:"allowMethods,omitempty"`
+	AllowOrigins     []string `json:"allowOrigins"`
+	ExposeHeaders    []string `json:"exposeHeaders,omitempty"`
+	MaxAge           int      `json:"maxAge,omitempty"`
+}
+
+// SecretKeyRef selects a key of a Secret in the namespace of the Ingress.
+type SecretKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+}
+
+// IPFilterSpec limits the clients by their IP.
+type IPFilterSpec struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// JWTSpec requires a bearer JWT of the issuer for the audience on every
+// read request.
+type JWTSpec struct {
+	Audience   string          `json:"audience"`
+	Issuer     string          `json:"issuer"`
+	JWKSSecret *SecretKeyRef   `json:"jwksSecret,omitempty"`
+	JWKSURL    string          `json:"jwksURL,omitempty"`
+	Prefixes   []JWTPrefixRule `json:"prefixes,omitempty"`
+}
+
+// JWTPrefixRule allows key prefixes to the tokens with a claim value.
+type JWTPrefixRule struct {
+	Claim    string   `json:"claim"`
+	Prefixes []string `json:"prefixes"`
+	Value    string   `json:"value,omitempty"`
+}
+
+// SignedURLSpec requires an HMAC signature on every read request.
+type SignedURLSpec struct {
+	KeySecret SecretKeyRef `json:"keySecret"`
+}
+
+// WriteSpec enables PUT and DELETE for requests with a bearer token.
+type WriteSpec struct {
+	TokenSecret SecretKeyRef `json:"tokenSecret"`
 }
 
 type S3Backend struct {
@@ -38,20 +129,114 @@ type S3BackendList struct {
 
 const S3BackendResource = "s3backends"
 
+func copyString(in *string) *string {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
+
+func copyInt(in *int) *int {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
+
+// DeepCopyInto copies the policy, its ages are pointers.
+func (in *CacheControlPolicy) DeepCopyInto(out *CacheControlPolicy) {
+	*out = *in
+	out.MaxAge = copyInt(in.MaxAge)
+	out.SMaxAge = copyInt(in.SMaxAge)
+}
+
 // DeepCopyInto copies all properties of this object into another object of the
 // same type that is provided as a pointer.
 func (in *S3Backend) DeepCopyInto(out *S3Backend) {
 	out.TypeMeta = in.TypeMeta
-	out.ObjectMeta = in.ObjectMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = S3BackendSpec{
-		AccessKey:       in.Spec.AccessKey,
-		BucketName:      in.Spec.BucketName,
-		Endpoint:        in.Spec.Endpoint,
-		MaxAgeSeconds:   in.Spec.MaxAgeSeconds,
-		MaxObjectSize:   in.Spec.MaxObjectSize,
-		Region:          in.Spec.Region,
-		SecretKey:       in.Spec.SecretKey,
-		TransferBufSize: in.Spec.TransferBufSize,
+		AccessKey:        in.Spec.AccessKey,
+		BucketName:       in.Spec.BucketName,
+		CacheControl:     in.Spec.CacheControl,
+		Compression:      in.Spec.Compression,
+		CORS:             in.Spec.CORS,
+		DirectoryListing: in.Spec.DirectoryListing,
+		Endpoint:         copyString(in.Spec.Endpoint),
+		ErrorDocuments:   in.Spec.ErrorDocuments,
+		ExposeMetadata:   append([]string(nil), in.Spec.ExposeMetadata...),
+		IndexDocument:    copyString(in.Spec.IndexDocument),
+		IPFilter:         in.Spec.IPFilter,
+		JWT:              in.Spec.JWT,
+		MaxAgeSeconds:    in.Spec.MaxAgeSeconds,
+		MaxObjectSize:    in.Spec.MaxObjectSize,
+		Region:           copyString(in.Spec.Region),
+		SecretKey:        in.Spec.SecretKey,
+		SignedURLs:       in.Spec.SignedURLs,
+		SPAFallback:      copyString(in.Spec.SPAFallback),
+		TransferBufSize:  in.Spec.TransferBufSize,
+		WebDAV:           in.Spec.WebDAV,
+		Write:            in.Spec.Write,
+	}
+	if in.Spec.CacheControl != nil {
+		cacheControl := CacheControlSpec{}
+		in.Spec.CacheControl.CacheControlPolicy.DeepCopyInto(&cacheControl.CacheControlPolicy)
+		if in.Spec.CacheControl.Overrides != nil {
+			cacheControl.Overrides = make([]CacheControlOverride, len(in.Spec.CacheControl.Overrides))
+			for i, override := range in.Spec.CacheControl.Overrides {
+				cacheControl.Overrides[i].Pattern = override.Pattern
+				override.CacheControlPolicy.DeepCopyInto(&cacheControl.Overrides[i].CacheControlPolicy)
+			}
+		}
+		out.Spec.CacheControl = &cacheControl
+	}
+	if in.Spec.Compression != nil {
+		compression := *in.Spec.Compression
+		compression.Types = append([]string(nil), in.Spec.Compression.Types...)
+		out.Spec.Compression = &compression
+	}
+	if in.Spec.CORS != nil {
+		cors := *in.Spec.CORS
+		cors.AllowHeaders = append([]string(nil), in.Spec.CORS.AllowHeaders...)
+		cors.AllowMethods = append([]string(nil), in.Spec.CORS.AllowMethods...)
+		cors.AllowOrigins = append([]string(nil), in.Spec.CORS.AllowOrigins...)
+		cors.ExposeHeaders = append([]string(nil), in.Spec.CORS.ExposeHeaders...)
+		out.Spec.CORS = &cors
+	}
+	if in.Spec.IPFilter != nil {
+		out.Spec.IPFilter = &IPFilterSpec{
+			Allow: append([]string(nil), in.Spec.IPFilter.Allow...),
+			Deny:  append([]string(nil), in.Spec.IPFilter.Deny...),
+		}
+	}
+	if in.Spec.JWT != nil {
+		jwt := *in.Spec.JWT
+		if in.Spec.JWT.JWKSSecret != nil {
+			jwksSecret := *in.Spec.JWT.JWKSSecret
+			jwt.JWKSSecret = &jwksSecret
+		}
+		jwt.Prefixes = make([]JWTPrefixRule, len(in.Spec.JWT.Prefixes))
+		for i, rule := range in.Spec.JWT.Prefixes {
+			rule.Prefixes = append([]string(nil), rule.Prefixes...)
+			jwt.Prefixes[i] = rule
+		}
+		out.Spec.JWT = &jwt
+	}
+	if in.Spec.SignedURLs != nil {
+		signedURLs := *in.Spec.SignedURLs
+		out.Spec.SignedURLs = &signedURLs
+	}
+	if in.Spec.Write != nil {
+		write := *in.Spec.Write
+		out.Spec.Write = &write
+	}
+	if in.Spec.ErrorDocuments != nil {
+		out.Spec.ErrorDocuments = make(map[string]string, len(in.Spec.ErrorDocuments))
+		for k, v := range in.Spec.ErrorDocuments {
+			out.Spec.ErrorDocuments[k] = v
+		}
 	}
 }
 
@@ -0,0 +1,78 @@
+package k8scrds
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestDeepCopyDoesNotAlias changes every pointer, slice and map of a copy
+// and expects the original to stay as it was.
+func TestDeepCopyDoesNotAlias(t *testing.T) {
+	s := func(v string) *string { return &v }
+	i := func(v int) *int { return &v }
+	in := &S3Backend{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Labels: map[string]string{"a": "b"}},
+		Spec: S3BackendSpec{
+			CacheControl: &CacheControlSpec{
+				CacheControlPolicy: CacheControlPolicy{MaxAge: i(60), SMaxAge: i(120)},
+				Overrides: []CacheControlOverride{
+					{Pattern: "*.html", CacheControlPolicy: CacheControlPolicy{MaxAge: i(0)}},
+				},
+			},
+			Compression:    &CompressionSpec{Types: []string{"text/*"}},
+			CORS:           &CORSSpec{AllowOrigins: []string{"*"}, AllowMethods: []string{"GET"}},
+			Endpoint:       s("http://s3"),
+			ErrorDocuments: map[string]string{"404": "404.html"},
+			ExposeMetadata: []string{"x"},
+			IndexDocument:  s("index.html"),
+			IPFilter:       &IPFilterSpec{Allow: []string{"10.0.0.0/8"}},
+			JWT: &JWTSpec{
+				JWKSSecret: &SecretKeyRef{Name: "jwks"},
+				Prefixes:   []JWTPrefixRule{{Claim: "sub", Prefixes: []string{"home/"}}},
+			},
+			Region:      s("eu"),
+			SignedURLs:  &SignedURLSpec{KeySecret: SecretKeyRef{Name: "keys"}},
+			SPAFallback: s("index.html"),
+			Write:       &WriteSpec{TokenSecret: SecretKeyRef{Name: "token"}},
+		},
+	}
+	before, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := in.DeepCopyObject().(*S3Backend)
+	if !reflect.DeepEqual(in, out) {
+		t.Fatal("copy differs from the original")
+	}
+
+	out.Labels["a"] = "changed"
+	*out.Spec.CacheControl.MaxAge = 1
+	*out.Spec.CacheControl.SMaxAge = 1
+	out.Spec.CacheControl.Overrides[0].Pattern = "changed"
+	*out.Spec.CacheControl.Overrides[0].MaxAge = 1
+	out.Spec.Compression.Types[0] = "changed"
+	out.Spec.CORS.AllowOrigins[0] = "changed"
+	out.Spec.CORS.AllowMethods[0] = "changed"
+	*out.Spec.Endpoint = "changed"
+	out.Spec.ErrorDocuments["404"] = "changed"
+	out.Spec.ExposeMetadata[0] = "changed"
+	*out.Spec.IndexDocument = "changed"
+	out.Spec.IPFilter.Allow[0] = "changed"
+	out.Spec.JWT.JWKSSecret.Name = "changed"
+	out.Spec.JWT.Prefixes[0].Prefixes[0] = "changed"
+	*out.Spec.Region = "changed"
+	out.Spec.SignedURLs.KeySecret.Name = "changed"
+	*out.Spec.SPAFallback = "changed"
+	out.Spec.Write.TokenSecret.Name = "changed"
+
+	after, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("original changed through the copy:\n%s\n%s", before, after)
+	}
+}
@@ -0,0 +1,201 @@
+package k8sinformers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mabels/diener/ctx"
+	k8scrds "github.com/mabels/diener/k8s/crds"
+	"github.com/rs/zerolog"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+const (
+	// CORSAllowOriginAnnotation enables CORS for the Ingress, a comma
+	// separated list of origins like the allowOrigins of an S3Backend.
+	CORSAllowOriginAnnotation      = "diener.adviser.com/cors-allow-origin"
+	CORSAllowMethodsAnnotation     = "diener.adviser.com/cors-allow-methods"
+	CORSAllowHeadersAnnotation     = "diener.adviser.com/cors-allow-headers"
+	CORSExposeHeadersAnnotation    = "diener.adviser.com/cors-expose-headers"
+	CORSAllowCredentialsAnnotation = "diener.adviser.com/cors-allow-credentials"
+	CORSMaxAgeAnnotation           = "diener.adviser.com/cors-max-age"
+	// AllowCIDRsAnnotation and DenyCIDRsAnnotation are comma separated
+	// CIDRs or IPs like the ipFilter of an S3Backend.
+	AllowCIDRsAnnotation = "diener.adviser.com/allow-cidrs"
+	DenyCIDRsAnnotation  = "diener.adviser.com/deny-cidrs"
+	// BasicAuthSecretAnnotation names a Secret with an htpasswd file in
+	// its "auth" key, its users may read the routes of the Ingress.
+	BasicAuthSecretAnnotation = "diener.adviser.com/auth-basic-secret"
+	BasicAuthRealmAnnotation  = "diener.adviser.com/auth-basic-realm"
+	// JWTIssuerAnnotation enables JWT authentication for the Ingress,
+	// without a jwt in the S3Backend the audience and one of the JWKS
+	// annotations have to be set too.
+	JWTIssuerAnnotation   = "diener.adviser.com/jwt-issuer"
+	JWTAudienceAnnotation = "diener.adviser.com/jwt-audience"
+	JWTJWKSURLAnnotation  = "diener.adviser.com/jwt-jwks-url"
+	// JWTJWKSSecretAnnotation names a Secret with the JWKS in its "jwks" key.
+	JWTJWKSSecretAnnotation = "diener.adviser.com/jwt-jwks-secret"
+	// RateLimitAnnotation enables rate limiting for the Ingress, the
+	// requests per second each bucket refills with.
+	RateLimitAnnotation      = "diener.adviser.com/rate-limit"
+	RateLimitBurstAnnotation = "diener.adviser.com/rate-limit-burst"
+	// RateLimitKeyAnnotation is "ip", "route" or "header:<name>".
+	RateLimitKeyAnnotation = "diener.adviser.com/rate-limit-key"
+	// WebDAVAnnotation "true" or "false" turns the WebDAV front end of
+	// the routes of the Ingress on or off.
+	WebDAVAnnotation = "diener.adviser.com/webdav"
+)
+
+// splitList splits a comma separated annotation value.
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// corsConfig is the CORS policy of the routes of an ingress. The
+// annotations of the ingress win over the cors of the S3Backend, nil
+// means no CORS at all.
+func corsConfig(log zerolog.Logger, ingress *netv1.Ingress, spec *k8scrds.CORSSpec) *ctx.CORSConfig {
+	if origins, found := ingress.Annotations[CORSAllowOriginAnnotation]; found {
+		cfg := &ctx.CORSConfig{
+			AllowOrigins:     splitList(origins),
+			AllowMethods:     splitList(ingress.Annotations[CORSAllowMethodsAnnotation]),
+			AllowHeaders:     splitList(ingress.Annotations[CORSAllowHeadersAnnotation]),
+			ExposeHeaders:    splitList(ingress.Annotations[CORSExposeHeadersAnnotation]),
+			AllowCredentials: ingress.Annotations[CORSAllowCredentialsAnnotation] == "true",
+		}
+		if maxAge, found := ingress.Annotations[CORSMaxAgeAnnotation]; found {
+			seconds, err := strconv.Atoi(maxAge)
+			if err != nil {
+				log.Warn().Err(err).Str("annotation", CORSMaxAgeAnnotation).Msg("ignore invalid annotation")
+			}
+			cfg.MaxAgeSeconds = seconds
+		}
+		return cfg
+	}
+	if spec == nil {
+		return nil
+	}
+	return &ctx.CORSConfig{
+		AllowOrigins:     spec.AllowOrigins,
+		AllowMethods:     spec.AllowMethods,
+		AllowHeaders:     spec.AllowHeaders,
+		ExposeHeaders:    spec.ExposeHeaders,
+		AllowCredentials: spec.AllowCredentials,
+		MaxAgeSeconds:    spec.MaxAge,
+	}
+}
+
+// webDAV reports if the routes of the ingress are served as WebDAV, the
+// annotation of the ingress wins over the webdav of the S3Backend.
+func webDAV(log zerolog.Logger, ingress *netv1.Ingress, spec bool) bool {
+	value, found := ingress.Annotations[WebDAVAnnotation]
+	if !found {
+		return spec
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warn().Err(err).Str("annotation", WebDAVAnnotation).Msg("ignore invalid annotation")
+		return spec
+	}
+	return enabled
+}
+
+// jwtConfig is the JWT authentication of the routes of an ingress and
+// the Secret to read the JWKS from, if any. The annotations of the ingress
+// win over the issuer, audience and keys of the jwt of the S3Backend, its
+// prefix rules are kept. nil means no JWT authentication.
+func jwtConfig(ingress *netv1.Ingress, spec *k8scrds.JWTSpec) (*ctx.JWTConfig, *k8scrds.SecretKeyRef) {
+	var cfg *ctx.JWTConfig
+	var jwksSecret *k8scrds.SecretKeyRef
+	if spec != nil {
+		cfg = &ctx.JWTConfig{
+			Issuer:   spec.Issuer,
+			Audience: spec.Audience,
+			JWKSURL:  spec.JWKSURL,
+		}
+		for _, rule := range spec.Prefixes {
+			cfg.Prefixes = append(cfg.Prefixes, ctx.JWTPrefixRule{
+				Claim:    rule.Claim,
+				Value:    rule.Value,
+				Prefixes: rule.Prefixes,
+			})
+		}
+		jwksSecret = spec.JWKSSecret
+	}
+	issuer, found := ingress.Annotations[JWTIssuerAnnotation]
+	if !found {
+		return cfg, jwksSecret
+	}
+	if cfg == nil {
+		cfg = &ctx.JWTConfig{}
+	}
+	cfg.Issuer = issuer
+	if audience, found := ingress.Annotations[JWTAudienceAnnotation]; found {
+		cfg.Audience = audience
+	}
+	url, urlFound := ingress.Annotations[JWTJWKSURLAnnotation]
+	name, secretFound := ingress.Annotations[JWTJWKSSecretAnnotation]
+	if urlFound || secretFound {
+		// the keys come from one place, the one of the annotations
+		cfg.JWKSURL = url
+		jwksSecret = nil
+		if secretFound {
+			jwksSecret = &k8scrds.SecretKeyRef{Name: name}
+		}
+	}
+	return cfg, jwksSecret
+}
+
+// ipFilterConfig is the IP filter of the routes of an ingress. Each
+// annotation of the ingress wins over its list in the ipFilter of the
+// S3Backend, the other list is kept. nil means every client is served.
+func ipFilterConfig(ingress *netv1.Ingress, spec *k8scrds.IPFilterSpec) *ctx.IPFilterConfig {
+	cfg := &ctx.IPFilterConfig{}
+	if spec != nil {
+		cfg.Allow = spec.Allow
+		cfg.Deny = spec.Deny
+	}
+	allow, allowFound := ingress.Annotations[AllowCIDRsAnnotation]
+	if allowFound {
+		cfg.Allow = splitList(allow)
+	}
+	deny, denyFound := ingress.Annotations[DenyCIDRsAnnotation]
+	if denyFound {
+		cfg.Deny = splitList(deny)
+	}
+	if spec == nil && !allowFound && !denyFound {
+		return nil
+	}
+	return cfg
+}
+
+// rateLimitConfig is the rate limit of the routes of an ingress, nil
+// means no limit.
+func rateLimitConfig(log zerolog.Logger, ingress *netv1.Ingress) *ctx.RateLimitConfig {
+	value, found := ingress.Annotations[RateLimitAnnotation]
+	if !found {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(value, 64)
+	if err != nil || rps <= 0 {
+		log.Warn().Err(err).Str("annotation", RateLimitAnnotation).Msg("ignore invalid annotation")
+		return nil
+	}
+	cfg := &ctx.RateLimitConfig{
+		RequestsPerSecond: rps,
+		Key:               ingress.Annotations[RateLimitKeyAnnotation],
+	}
+	if burst, found := ingress.Annotations[RateLimitBurstAnnotation]; found {
+		cfg.Burst, err = strconv.Atoi(burst)
+		if err != nil {
+			log.Warn().Err(err).Str("annotation", RateLimitBurstAnnotation).Msg("ignore invalid annotation")
+		}
+	}
+	return cfg
+}
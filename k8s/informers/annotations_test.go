@@ -0,0 +1,131 @@
+package k8sinformers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mabels/diener/ctx"
+	k8scrds "github.com/mabels/diener/k8s/crds"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func annotatedIngress(annotations map[string]string) *netv1.Ingress {
+	return &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress", Annotations: annotations}}
+}
+
+func TestIPFilterConfig(t *testing.T) {
+	spec := &k8scrds.IPFilterSpec{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        *k8scrds.IPFilterSpec
+		want        *ctx.IPFilterConfig
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "spec",
+			spec: spec,
+			want: &ctx.IPFilterConfig{Allow: spec.Allow, Deny: spec.Deny},
+		},
+		{
+			name:        "deny keeps the allow list of the spec",
+			annotations: map[string]string{DenyCIDRsAnnotation: "10.2.0.0/16, 10.3.0.1"},
+			spec:        spec,
+			want:        &ctx.IPFilterConfig{Allow: spec.Allow, Deny: []string{"10.2.0.0/16", "10.3.0.1"}},
+		},
+		{
+			name:        "allow keeps the deny list of the spec",
+			annotations: map[string]string{AllowCIDRsAnnotation: "192.0.2.0/24"},
+			spec:        spec,
+			want:        &ctx.IPFilterConfig{Allow: []string{"192.0.2.0/24"}, Deny: spec.Deny},
+		},
+		{
+			name:        "annotations without spec",
+			annotations: map[string]string{DenyCIDRsAnnotation: "192.0.2.1"},
+			want:        &ctx.IPFilterConfig{Deny: []string{"192.0.2.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ipFilterConfig(annotatedIngress(tt.annotations), tt.spec)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTConfig(t *testing.T) {
+	spec := &k8scrds.JWTSpec{
+		Issuer:     "https://login.example.com",
+		Audience:   "diener",
+		JWKSSecret: &k8scrds.SecretKeyRef{Name: "jwks", Key: "jwks"},
+		Prefixes:   []k8scrds.JWTPrefixRule{{Claim: "sub", Prefixes: []string{"home/{value}/"}}},
+	}
+	rules := []ctx.JWTPrefixRule{{Claim: "sub", Prefixes: []string{"home/{value}/"}}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        *k8scrds.JWTSpec
+		want        *ctx.JWTConfig
+		wantSecret  *k8scrds.SecretKeyRef
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:       "spec",
+			spec:       spec,
+			want:       &ctx.JWTConfig{Issuer: spec.Issuer, Audience: "diener", Prefixes: rules},
+			wantSecret: spec.JWKSSecret,
+		},
+		{
+			name:        "issuer keeps prefixes and keys",
+			annotations: map[string]string{JWTIssuerAnnotation: "https://other.example.com"},
+			spec:        spec,
+			want:        &ctx.JWTConfig{Issuer: "https://other.example.com", Audience: "diener", Prefixes: rules},
+			wantSecret:  spec.JWKSSecret,
+		},
+		{
+			name: "jwks url replaces the jwks secret",
+			annotations: map[string]string{
+				JWTIssuerAnnotation:   "https://other.example.com",
+				JWTAudienceAnnotation: "other",
+				JWTJWKSURLAnnotation:  "https://other.example.com/jwks.json",
+			},
+			spec: spec,
+			want: &ctx.JWTConfig{Issuer: "https://other.example.com", Audience: "other", JWKSURL: "https://other.example.com/jwks.json", Prefixes: rules},
+		},
+		{
+			name: "annotations without spec",
+			annotations: map[string]string{
+				JWTIssuerAnnotation:     "https://other.example.com",
+				JWTAudienceAnnotation:   "other",
+				JWTJWKSSecretAnnotation: "keys",
+			},
+			want:       &ctx.JWTConfig{Issuer: "https://other.example.com", Audience: "other"},
+			wantSecret: &k8scrds.SecretKeyRef{Name: "keys"},
+		},
+		{
+			name:        "audience alone is ignored",
+			annotations: map[string]string{JWTAudienceAnnotation: "other"},
+			spec:        spec,
+			want:        &ctx.JWTConfig{Issuer: spec.Issuer, Audience: "diener", Prefixes: rules},
+			wantSecret:  spec.JWKSSecret,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, secret := jwtConfig(annotatedIngress(tt.annotations), tt.spec)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(secret, tt.wantSecret) {
+				t.Errorf("secret %+v, want %+v", secret, tt.wantSecret)
+			}
+		})
+	}
+}
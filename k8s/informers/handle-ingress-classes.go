@@ -0,0 +1,117 @@
+package k8sinformers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	netv1 "k8s.io/api/networking/v1"
+	informernetv1 "k8s.io/client-go/informers/networking/v1"
+	kubernetes "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// IsDefaultClassAnnotation marks the IngressClass used by Ingresses without a class.
+	IsDefaultClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+	// LegacyIngressClassAnnotation predates spec.ingressClassName.
+	LegacyIngressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+type ingressClassRegistry struct {
+	mutex       sync.RWMutex
+	controllers map[string]string
+	defaults    map[string]bool
+}
+
+var ingressClasses = ingressClassRegistry{
+	controllers: map[string]string{},
+	defaults:    map[string]bool{},
+}
+
+func (icr *ingressClassRegistry) set(ic *netv1.IngressClass) {
+	icr.mutex.Lock()
+	defer icr.mutex.Unlock()
+	icr.controllers[ic.Name] = ic.Spec.Controller
+	icr.defaults[ic.Name] = ic.Annotations[IsDefaultClassAnnotation] == "true"
+}
+
+func (icr *ingressClassRegistry) remove(name string) {
+	icr.mutex.Lock()
+	defer icr.mutex.Unlock()
+	delete(icr.controllers, name)
+	delete(icr.defaults, name)
+}
+
+// accepts resolves the class of the ingress and reports if it belongs to
+// the controller. spec.ingressClassName wins over the legacy annotation,
+// without both the ingress belongs to the default IngressClass.
+func (icr *ingressClassRegistry) accepts(ingress *netv1.Ingress, controller string) bool {
+	icr.mutex.RLock()
+	defer icr.mutex.RUnlock()
+	if ingress.Spec.IngressClassName != nil {
+		return icr.controllers[*ingress.Spec.IngressClassName] == controller
+	}
+	if class, found := ingress.Annotations[LegacyIngressClassAnnotation]; found {
+		return icr.controllers[class] == controller
+	}
+	for class, isDefault := range icr.defaults {
+		if isDefault && icr.controllers[class] == controller {
+			return true
+		}
+	}
+	return false
+}
+
+func ingressClassFromObj(obj interface{}) (*netv1.IngressClass, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ic, ok := obj.(*netv1.IngressClass)
+	return ic, ok
+}
+
+// IngressClassInformer keeps the known IngressClasses up to date, every
+// change re-evaluates which Ingresses diener serves.
+func IngressClassInformer(config *rest.Config, log zerolog.Logger) (cache.SharedIndexInformer, error) {
+	kif, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Error().Err(err).Msg("new for config")
+		return nil, err
+	}
+	log = log.With().Str("component", "ingress-class-informer").Logger()
+	informer := informernetv1.NewIngressClassInformer(kif, time.Minute, cache.Indexers{})
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ic, ok := ingressClassFromObj(obj)
+			if !ok {
+				log.Warn().Str("func", "AddFunc").Msg("not an ingress class")
+				return
+			}
+			log.Info().Str("name", ic.Name).Str("controller", ic.Spec.Controller).Msg("add ingress class")
+			ingressClasses.set(ic)
+			resyncIngressHandlers()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			ic, ok := ingressClassFromObj(newObj)
+			if !ok {
+				log.Warn().Str("func", "UpdateFunc").Msg("not an ingress class")
+				return
+			}
+			ingressClasses.set(ic)
+			resyncIngressHandlers()
+		},
+		DeleteFunc: func(obj interface{}) {
+			ic, ok := ingressClassFromObj(obj)
+			if !ok {
+				log.Warn().Str("func", "DeleteFunc").Msg("not an ingress class")
+				return
+			}
+			log.Info().Str("name", ic.Name).Msg("delete ingress class")
+			ingressClasses.remove(ic.Name)
+			resyncIngressHandlers()
+		},
+	})
+	return informer, nil
+}
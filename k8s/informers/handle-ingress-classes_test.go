@@ -0,0 +1,94 @@
+package k8sinformers
+
+import (
+	"testing"
+
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testController = "adviser.com/diener"
+
+func ingressClass(name, controller string, isDefault bool) *netv1.IngressClass {
+	ic := &netv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       netv1.IngressClassSpec{Controller: controller},
+	}
+	if isDefault {
+		ic.Annotations = map[string]string{IsDefaultClassAnnotation: "true"}
+	}
+	return ic
+}
+
+func classIngress(className *string, legacy string) *netv1.Ingress {
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"},
+		Spec:       netv1.IngressSpec{IngressClassName: className},
+	}
+	if legacy != "" {
+		ingress.Annotations = map[string]string{LegacyIngressClassAnnotation: legacy}
+	}
+	return ingress
+}
+
+func TestIngressClassAccepts(t *testing.T) {
+	diener, nginx, missing := "diener", "nginx", "missing"
+	tests := []struct {
+		name      string
+		className *string
+		legacy    string
+		// defaultClass is the class marked as default, if any
+		defaultClass string
+		want         bool
+	}{
+		{name: "className", className: &diener, want: true},
+		{name: "className of another controller", className: &nginx},
+		{name: "unknown className", className: &missing},
+		{name: "className wins over the annotation", className: &nginx, legacy: "diener"},
+		{name: "className wins over the annotation of another", className: &diener, legacy: "nginx", want: true},
+		{name: "legacy annotation", legacy: "diener", want: true},
+		{name: "legacy annotation of another controller", legacy: "nginx"},
+		{name: "legacy annotation wins over the default", legacy: "nginx", defaultClass: "diener"},
+		{name: "default class", defaultClass: "diener", want: true},
+		{name: "default class of another controller", defaultClass: "nginx"},
+		{name: "no default class"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icr := &ingressClassRegistry{controllers: map[string]string{}, defaults: map[string]bool{}}
+			icr.set(ingressClass("diener", testController, tt.defaultClass == "diener"))
+			icr.set(ingressClass("nginx", "k8s.io/ingress-nginx", tt.defaultClass == "nginx"))
+			if got := icr.accepts(classIngress(tt.className, tt.legacy), testController); got != tt.want {
+				t.Errorf("accepts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngressClassChanges(t *testing.T) {
+	icr := &ingressClassRegistry{controllers: map[string]string{}, defaults: map[string]bool{}}
+	diener := "diener"
+	named, unnamed := classIngress(&diener, ""), classIngress(nil, "")
+	if icr.accepts(named, testController) || icr.accepts(unnamed, testController) {
+		t.Fatal("accepted before the IngressClass exists")
+	}
+
+	icr.set(ingressClass("diener", testController, true))
+	if !icr.accepts(named, testController) || !icr.accepts(unnamed, testController) {
+		t.Error("refused once the default IngressClass exists")
+	}
+
+	// the class loses its default mark
+	icr.set(ingressClass("diener", testController, false))
+	if !icr.accepts(named, testController) {
+		t.Error("refused the named class after it stopped being the default")
+	}
+	if icr.accepts(unnamed, testController) {
+		t.Error("accepted without class after the default mark was removed")
+	}
+
+	icr.remove("diener")
+	if icr.accepts(named, testController) {
+		t.Error("accepted after the IngressClass was deleted")
+	}
+}
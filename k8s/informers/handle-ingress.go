@@ -1,6 +1,7 @@
 package k8sinformers
 
 import (
+	"net/http"
 	"reflect"
 	"sync"
 	"time"
@@ -11,9 +12,11 @@ import (
 	s3backend "github.com/mabels/diener/backend/s3"
 	"github.com/mabels/diener/ctx"
 	k8scrds "github.com/mabels/diener/k8s/crds"
+	"github.com/mabels/diener/middleware"
 	"github.com/rs/zerolog"
 	netv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
 	informernetv1 "k8s.io/client-go/informers/networking/v1"
 	kubernetes "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -42,21 +45,119 @@ type ingressHandler struct {
 	log            zerolog.Logger
 	dienerApi      k8scrds.DienerV1Alpha1Interface
 	rcache         *ristretto.Cache
+	metaCache      *ristretto.Cache
 	dynamicBackend *s3backend.DynamicBackend
+	secretInformer cache.SharedIndexInformer
+	tlsCerts       *TLSCertificates
+	status         *statusPublisher
+
+	// managed are the ingresses whose routes are in the dynamicBackend
+	managedMutex sync.Mutex
+	managed      map[string]*netv1.Ingress
+	// secretUsers maps a Secret name to the keys of the managed ingresses
+	// whose routes were built from it, guarded by managedMutex
+	secretUsers map[string]map[string]bool
+}
+
+type ingressPath struct {
+	host      string
+	isDefault bool
+	netv1.HTTPIngressPath
 }
 
-func getPaths(ingress *netv1.Ingress) []netv1.HTTPIngressPath {
-	paths := []netv1.HTTPIngressPath{}
+// getPaths flattens the rules of the ingress. The spec.defaultBackend
+// becomes a catch-all path for every host of the rules, or for every host
+// at all if there are no rules.
+func getPaths(ingress *netv1.Ingress) []ingressPath {
+	paths := []ingressPath{}
+	hosts := []string{}
+	seen := map[string]bool{}
 	for _, rule := range ingress.Spec.Rules {
-		paths = append(paths, rule.HTTP.Paths...)
-		// for _, path := range rule.HTTP.Paths {
-		// 	paths = append(paths, path)
-		// }
+		if !seen[rule.Host] {
+			seen[rule.Host] = true
+			hosts = append(hosts, rule.Host)
+		}
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			paths = append(paths, ingressPath{host: rule.Host, HTTPIngressPath: path})
+		}
+	}
+	if ingress.Spec.DefaultBackend != nil {
+		if len(hosts) == 0 {
+			hosts = append(hosts, "")
+		}
+		prefix := netv1.PathTypePrefix
+		for _, host := range hosts {
+			paths = append(paths, ingressPath{
+				host:      host,
+				isDefault: true,
+				HTTPIngressPath: netv1.HTTPIngressPath{
+					Path:     "/",
+					PathType: &prefix,
+					Backend:  *ingress.Spec.DefaultBackend,
+				},
+			})
+		}
 	}
 	return paths
 }
 
-func (ih ingressHandler) AddFunc(obj interface{}) {
+func (path ingressPath) route(ingress *netv1.Ingress) s3backend.Route {
+	return s3backend.Route{
+		Ingress:  ingressKey(ingress),
+		Host:     path.host,
+		Path:     path.Path,
+		PathType: pathType(path.PathType),
+		Default:  path.isDefault,
+	}
+}
+
+func ingressKey(ingress *netv1.Ingress) string {
+	return ingress.Namespace + "/" + ingress.Name
+}
+
+func pathType(pt *netv1.PathType) s3backend.PathType {
+	if pt == nil {
+		return s3backend.PathTypeImplementationSpecific
+	}
+	switch *pt {
+	case netv1.PathTypeExact:
+		return s3backend.PathTypeExact
+	case netv1.PathTypePrefix:
+		return s3backend.PathTypePrefix
+	default:
+		return s3backend.PathTypeImplementationSpecific
+	}
+}
+
+// cacheControl maps the Cache-Control policy of an S3Backend.
+func cacheControl(spec *k8scrds.CacheControlSpec) (*ctx.CacheControl, []ctx.CacheControlOverride) {
+	if spec == nil {
+		return nil, nil
+	}
+	policy := func(p k8scrds.CacheControlPolicy) ctx.CacheControl {
+		return ctx.CacheControl{
+			MaxAgeSeconds:  p.MaxAge,
+			SMaxAgeSeconds: p.SMaxAge,
+			Immutable:      p.Immutable,
+			NoCache:        p.NoCache,
+			NoStore:        p.NoStore,
+		}
+	}
+	defaults := policy(spec.CacheControlPolicy)
+	overrides := make([]ctx.CacheControlOverride, 0, len(spec.Overrides))
+	for _, o := range spec.Overrides {
+		overrides = append(overrides, ctx.CacheControlOverride{
+			Pattern:      o.Pattern,
+			CacheControl: policy(o.CacheControlPolicy),
+		})
+	}
+	return &defaults, overrides
+}
+
+func (ih *ingressHandler) AddFunc(obj interface{}) {
 
 }
 
@@ -69,14 +170,91 @@ func (ih ingressHandler) AddFunc(obj interface{}) {
 // var pathHandlers = map[string]pathHandler{}
 // var pathHandlerMutex = sync.Mutex{}
 
-func (ih ingressHandler) OnAdd(obj interface{}, isInInitialList bool) {
-	log := ih.log
-	ingress, found := obj.(*netv1.Ingress)
+func ingressFromObj(obj interface{}) (*netv1.Ingress, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ingress, ok := obj.(*netv1.Ingress)
+	return ingress, ok
+}
+
+// reconcile adds, replaces or drops the routes of the ingress depending
+// on whether its IngressClass belongs to our controller.
+func (ih *ingressHandler) reconcile(ingress *netv1.Ingress) {
+	log := ih.log.With().Str("name", ingress.Name).Str("uid", string(ingress.UID)).Logger()
+	accepted := ingressClasses.accepts(ingress, ih.appCtx.Cfg.Ingress.ControllerName)
+	key := ingressKey(ingress)
+
+	ih.managedMutex.Lock()
+	defer ih.managedMutex.Unlock()
+	prev, managed := ih.managed[key]
+	// the annotations configure the routes as well
+	// a changed address is published by republish
+	if managed && accepted && reflect.DeepEqual(prev.Spec, ingress.Spec) && reflect.DeepEqual(prev.Annotations, ingress.Annotations) {
+		ih.managed[key] = ingress
+		return
+	}
+	if managed {
+		ih.forgetSecrets(key)
+		delete(ih.managed, key)
+	}
+	if !accepted {
+		if managed {
+			ih.deleteRoutes(prev)
+			ih.tlsCerts.DeleteIngress(prev)
+			log.Info().Msg("ingress class no longer ours")
+			ih.status.Clear(ingress)
+		} else {
+			log.Debug().Msg("ignore ingress of other ingress class")
+		}
+		return
+	}
+	// the previous routes and certificates are swapped for the new ones
+	// at once
+	ih.replaceRoutes(log, ingress)
+	ih.tlsCerts.SetIngress(ingress)
+	ih.loadTLSSecrets(ingress)
+	ih.managed[key] = ingress
+	ih.status.Publish(ingress)
+}
+
+// republish writes the current address into the status of every
+// managed ingress.
+func (ih *ingressHandler) republish() {
+	ih.managedMutex.Lock()
+	defer ih.managedMutex.Unlock()
+	for _, ingress := range ih.managed {
+		ih.status.Publish(ingress)
+	}
+}
+
+// resync re-evaluates every ingress known to the informer.
+func (ih *ingressHandler) resync() {
+	for _, obj := range ih.informer.GetStore().List() {
+		if ingress, ok := ingressFromObj(obj); ok {
+			ih.reconcile(ingress)
+		}
+	}
+}
+
+func (ih *ingressHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	ingress, found := ingressFromObj(obj)
 	if !found {
-		log.Error().Msg("ingress not found")
+		ih.log.Error().Msg("ingress not found")
 		return
 	}
-	log = log.With().Str("name", ingress.Name).Str("uid", string(ingress.UID)).Logger()
+	ih.reconcile(ingress)
+}
+
+// replaceRoutes swaps the routes of the ingress in the dynamicBackend for
+// the ones built from its current spec.
+func (ih *ingressHandler) replaceRoutes(log zerolog.Logger, ingress *netv1.Ingress) {
+	ih.dynamicBackend.ReplaceRoutes(log, ingressKey(ingress), ih.routes(log, ingress))
+}
+
+// routes builds the routes of the paths backed by S3Backends.
+func (ih *ingressHandler) routes(log zerolog.Logger, ingress *netv1.Ingress) []s3backend.Route {
+	routes := []s3backend.Route{}
 	for _, path := range getPaths(ingress) {
 		if path.Backend.Resource != nil {
 			if path.Backend.Resource.APIGroup != nil && *path.Backend.Resource.APIGroup != "diener.adviser.com" {
@@ -95,11 +273,38 @@ func (ih ingressHandler) OnAdd(obj interface{}, isInInitialList bool) {
 			if s3b.Spec.Region != nil {
 				region = *s3b.Spec.Region
 			}
-			fs, err := s3backend.NewS3Backend(ih.appCtx, ih.rcache, ctx.S3BackendConfig{
-				BucketName:      s3b.Spec.BucketName,
-				MaxObjectSize:   s3b.Spec.MaxObjectSize,
-				TransferBufSize: s3b.Spec.TransferBufSize,
-				MaxAgeSeconds:   s3b.Spec.MaxAgeSeconds,
+			indexDocument := ""
+			if s3b.Spec.IndexDocument != nil {
+				indexDocument = *s3b.Spec.IndexDocument
+			}
+			spaFallback := ""
+			if s3b.Spec.SPAFallback != nil {
+				spaFallback = *s3b.Spec.SPAFallback
+			}
+			defaultCacheControl, cacheControlOverrides := cacheControl(s3b.Spec.CacheControl)
+			compression := ctx.CompressionConfig{}
+			if s3b.Spec.Compression != nil {
+				compression = ctx.CompressionConfig{
+					Precompressed: s3b.Spec.Compression.Precompressed,
+					OnTheFly:      s3b.Spec.Compression.OnTheFly,
+					MinSize:       s3b.Spec.Compression.MinSize,
+					Types:         s3b.Spec.Compression.Types,
+				}
+			}
+			fs, err := s3backend.NewS3Backend(ih.appCtx, ih.rcache, ih.metaCache, ctx.S3BackendConfig{
+				BucketName:            s3b.Spec.BucketName,
+				MaxObjectSize:         s3b.Spec.MaxObjectSize,
+				TransferBufSize:       s3b.Spec.TransferBufSize,
+				MaxAgeSeconds:         s3b.Spec.MaxAgeSeconds,
+				IndexDocument:         indexDocument,
+				SPAFallback:           spaFallback,
+				ErrorDocuments:        s3b.Spec.ErrorDocuments,
+				DirectoryListing:      s3b.Spec.DirectoryListing,
+				ExposeMetadata:        s3b.Spec.ExposeMetadata,
+				CacheControl:          defaultCacheControl,
+				CacheControlOverrides: cacheControlOverrides,
+				Compression:           compression,
+				Write:                 s3b.Spec.Write != nil,
 				Credentials: aws.Credentials{
 					AccessKeyID:     s3b.Spec.AccessKey,
 					SecretAccessKey: s3b.Spec.SecretKey,
@@ -111,42 +316,114 @@ func (ih ingressHandler) OnAdd(obj interface{}, isInInitialList bool) {
 				},
 			})
 			if err != nil {
-				log.Error().Err(err).Msg("new s3 backend")
-				return
+				// the other paths of the ingress stay served
+				log.Error().Err(err).Str("path", path.Path).Msg("new s3 backend")
+				continue
 			}
-			ih.dynamicBackend.PrependRoute(log, s3backend.Route{
-				Path: path.Path,
-				FS:   fs,
-			})
+			route := path.route(ingress)
+			route.FS = fs
+			readMethods := []string{http.MethodGet, http.MethodHead}
+			writeMethods := []string{http.MethodPut, http.MethodDelete}
+			davMode := webDAV(log, ingress, s3b.Spec.WebDAV)
+			if davMode {
+				route.Handler = s3backend.NewWebDAVHandler(log, fs, route.MountPoint())
+				readMethods = append(readMethods, "PROPFIND")
+				writeMethods = s3backend.WebDAVWriteMethods
+			}
+			basicSecret, basicAuth := ingress.Annotations[BasicAuthSecretAnnotation]
+			realm := ingress.Annotations[BasicAuthRealmAnnotation]
+			if realm == "" {
+				realm = "diener"
+			}
+			// WebDAV clients mount with one set of Basic credentials,
+			// the htpasswd users write with the ones they read with
+			davBasicWrites := davMode && basicAuth && s3b.Spec.Write != nil
+			if ipFilter := ipFilterConfig(ingress, s3b.Spec.IPFilter); ipFilter != nil {
+				route.Middlewares = append(route.Middlewares, middleware.NewIPFilter(log, *ipFilter).Wrap)
+			}
+			if rateLimit := rateLimitConfig(log, ingress); rateLimit != nil {
+				name := route.Ingress + " " + route.Host + route.Path
+				route.Middlewares = append(route.Middlewares, middleware.NewRateLimit(log, ih.appCtx.Meter, name, *rateLimit).Wrap)
+			}
+			if cors := corsConfig(log, ingress, s3b.Spec.CORS); cors != nil {
+				route.Middlewares = append(route.Middlewares, middleware.NewCORS(log, *cors).Wrap)
+			}
+			if basicAuth {
+				// without the Secret there are no users and reads are refused
+				htpasswd := ih.secretLines(ingress, k8scrds.SecretKeyRef{Name: basicSecret}, "auth")
+				methods := readMethods
+				if davBasicWrites {
+					methods = append(append([]string{}, readMethods...), writeMethods...)
+				}
+				route.Middlewares = append(route.Middlewares, middleware.NewBasicAuth(log, realm, htpasswd, methods...).Wrap)
+			}
+			if s3b.Spec.SignedURLs != nil {
+				// without the Secret no signature is valid and reads are refused
+				keys := ih.secretLines(ingress, s3b.Spec.SignedURLs.KeySecret, "key")
+				route.Middlewares = append(route.Middlewares, middleware.NewSignedURL(log, keys, readMethods...).Wrap)
+			}
+			if jwt, jwksSecret := jwtConfig(ingress, s3b.Spec.JWT); jwt != nil {
+				if jwksSecret != nil {
+					// without the Secret there are no keys and reads are refused
+					jwt.JWKS, _ = ih.secretValue(ingress, *jwksSecret, "jwks")
+					jwt.JWKSURL = ""
+				}
+				route.Middlewares = append(route.Middlewares, middleware.NewJWTAuth(log, *jwt, route.MountPoint(), readMethods...).Wrap)
+			}
+			if s3b.Spec.Write != nil && !davBasicWrites {
+				// without the Secret no token is valid and writes are refused
+				tokens := ih.secretLines(ingress, s3b.Spec.Write.TokenSecret, "token")
+				bearer := middleware.NewBearerAuth(log, tokens, writeMethods...)
+				if davMode {
+					bearer.AcceptBasic(realm)
+				}
+				route.Middlewares = append(route.Middlewares, bearer.Wrap)
+			}
+			routes = append(routes, route)
 		}
 
 	}
+	return routes
 }
 
-func (ih ingressHandler) OnUpdate(oldObj, newObj interface{}) {
-	oldIngress, oldFound := oldObj.(*netv1.Ingress)
-	newIngress, newFound := oldObj.(*netv1.Ingress)
-	if oldFound && newFound && !reflect.DeepEqual(oldIngress.Spec, newIngress.Spec) {
-		ih.OnDelete(oldObj)
-		ih.OnAdd(newObj, false)
+func (ih *ingressHandler) OnUpdate(oldObj, newObj interface{}) {
+	newIngress, newFound := ingressFromObj(newObj)
+	if !newFound {
+		ih.log.Error().Msg("ingress not found")
+		return
 	}
+	ih.reconcile(newIngress)
 }
-func (ih ingressHandler) OnDelete(obj interface{}) {
-	ingress, found := obj.(*netv1.Ingress)
-	if found {
-		log := ih.log.With().Str("name", ingress.Name).Str("uid", string(ingress.UID)).Logger()
-		for _, path := range getPaths(ingress) {
-			log = log.With().Str("path", path.Path).Logger()
-			ih.dynamicBackend.DeleteRoute(log, path.Path)
-		}
+
+func (ih *ingressHandler) OnDelete(obj interface{}) {
+	ingress, found := ingressFromObj(obj)
+	if !found {
+		return
+	}
+	key := ingressKey(ingress)
+	ih.managedMutex.Lock()
+	defer ih.managedMutex.Unlock()
+	if prev, managed := ih.managed[key]; managed {
+		ih.deleteRoutes(prev)
+		ih.tlsCerts.DeleteIngress(prev)
+		ih.forgetSecrets(key)
+		delete(ih.managed, key)
+	}
+}
+
+func (ih *ingressHandler) deleteRoutes(ingress *netv1.Ingress) {
+	log := ih.log.With().Str("name", ingress.Name).Str("uid", string(ingress.UID)).Logger()
+	for _, path := range getPaths(ingress) {
+		log := log.With().Str("host", path.host).Str("path", path.Path).Logger()
+		ih.dynamicBackend.DeleteRoute(log, path.route(ingress))
 	}
 }
 
-var ingressInformers = map[string]ingressHandler{}
+var ingressInformers = map[string]*ingressHandler{}
 
 var ingressMutex = sync.Mutex{}
 
-func NewIngressHandlerByNamespace(ns string, appCtx ctx.AppCtx, config *rest.Config, dynamicBackend *s3backend.DynamicBackend, dienerApi k8scrds.DienerV1Alpha1Interface, rcache *ristretto.Cache) {
+func NewIngressHandlerByNamespace(ns string, appCtx ctx.AppCtx, config *rest.Config, dynamicBackend *s3backend.DynamicBackend, dienerApi k8scrds.DienerV1Alpha1Interface, rcache *ristretto.Cache, metaCache *ristretto.Cache, tlsCerts *TLSCertificates) {
 	log := appCtx.Log.With().Str("namespace", ns).Str("component", "ingress-handler").Logger()
 	ingressMutex.Lock()
 	defer ingressMutex.Unlock()
@@ -163,33 +440,72 @@ func NewIngressHandlerByNamespace(ns string, appCtx ctx.AppCtx, config *rest.Con
 	}
 	indexers := map[string]cache.IndexFunc{}
 	informer := informernetv1.NewIngressInformer(kif, ns, time.Minute, indexers)
-	ih := ingressHandler{
-		stopCh:         make(chan struct{}, 1),
+	ih := &ingressHandler{
+		stopCh:         make(chan struct{}),
 		indexers:       indexers,
 		informer:       informer,
 		namespace:      ns,
 		appCtx:         appCtx,
 		rcache:         rcache,
+		metaCache:      metaCache,
 		dynamicBackend: dynamicBackend,
 		log:            log,
 		dienerApi:      dienerApi,
+		secretInformer: informercorev1.NewSecretInformer(kif, ns, time.Minute, cache.Indexers{}),
+		tlsCerts:       tlsCerts,
+		status:         newStatusPublisher(appCtx, kif, log),
+		managed:        map[string]*netv1.Ingress{},
+		secretUsers:    map[string]map[string]bool{},
 	}
+	ih.secretInformer.AddEventHandler(ih.secretEventHandler())
 	informer.AddEventHandler(ih)
 
 	ingressInformers[ns] = ih
 
-	go informer.Run(ih.stopCh)
+	go ih.secretInformer.Run(ih.stopCh)
+	ih.status.run(ih.stopCh, ih.republish)
+	go func() {
+		// the routes and certificates are built from the Secrets, the
+		// status from the publish Service
+		if !cache.WaitForCacheSync(ih.stopCh, ih.secretInformer.HasSynced, ih.status.hasSynced) {
+			return
+		}
+		informer.Run(ih.stopCh)
+	}()
 
 	ih.log.Info().Msg("started ingress informer")
 }
 
 func DeleteIngressHandlerByNamespace(ns string, appCtx ctx.AppCtx) {
+	ingressMutex.Lock()
+	defer ingressMutex.Unlock()
 	ih, found := ingressInformers[ns]
 	if !found {
 		appCtx.Log.Warn().Str("namespace", ns).Msg("ingress handler does not exist")
 		return
 	}
-	ih.stopCh <- struct{}{}
+	close(ih.stopCh)
 	delete(ingressInformers, ns)
+	ih.managedMutex.Lock()
+	for key, ingress := range ih.managed {
+		ih.deleteRoutes(ingress)
+		ih.tlsCerts.DeleteIngress(ingress)
+		delete(ih.managed, key)
+	}
+	ih.managedMutex.Unlock()
 	ih.log.Info().Msg("delete ingress informer")
 }
+
+// resyncIngressHandlers re-evaluates the ingresses of all namespaces,
+// needed whenever the IngressClasses change.
+func resyncIngressHandlers() {
+	ingressMutex.Lock()
+	handlers := make([]*ingressHandler, 0, len(ingressInformers))
+	for _, ih := range ingressInformers {
+		handlers = append(handlers, ih)
+	}
+	ingressMutex.Unlock()
+	for _, ih := range handlers {
+		ih.resync()
+	}
+}
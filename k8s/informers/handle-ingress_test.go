@@ -0,0 +1,231 @@
+package k8sinformers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	s3backend "github.com/mabels/diener/backend/s3"
+	"github.com/mabels/diener/ctx"
+	k8scrds "github.com/mabels/diener/k8s/crds"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// fakeDiener serves the S3Backends by name, of every namespace.
+type fakeDiener map[string]*k8scrds.S3Backend
+
+func (fd fakeDiener) S3Backends(namespace string) k8scrds.S3BackendInterface {
+	return fd
+}
+
+func (fd fakeDiener) List(opts metav1.ListOptions) (*k8scrds.S3BackendList, error) {
+	list := &k8scrds.S3BackendList{}
+	for _, s3b := range fd {
+		list.Items = append(list.Items, *s3b)
+	}
+	return list, nil
+}
+
+func (fd fakeDiener) Get(name string, options metav1.GetOptions) (*k8scrds.S3Backend, error) {
+	s3b, found := fd[name]
+	if !found {
+		return nil, fmt.Errorf("s3backend %s not found", name)
+	}
+	return s3b, nil
+}
+
+func (fd fakeDiener) Create(s3b *k8scrds.S3Backend) (*k8scrds.S3Backend, error) {
+	fd[s3b.Name] = s3b
+	return s3b, nil
+}
+
+func (fd fakeDiener) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return watch.NewEmptyWatch(), nil
+}
+
+func newTestIngressHandler(s3backends ...string) *ingressHandler {
+	fd := fakeDiener{}
+	for _, name := range s3backends {
+		fd[name] = &k8scrds.S3Backend{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec:       k8scrds.S3BackendSpec{BucketName: name},
+		}
+	}
+	return &ingressHandler{
+		appCtx:      ctx.AppCtx{Ctx: context.Background(), Log: zerolog.Nop()},
+		log:         zerolog.Nop(),
+		dienerApi:   fd,
+		secretUsers: map[string]map[string]bool{},
+	}
+}
+
+func s3Backend(name string) netv1.IngressBackend {
+	return netv1.IngressBackend{Resource: &corev1.TypedLocalObjectReference{Kind: "S3Backend", Name: name}}
+}
+
+func rule(host string, paths ...netv1.HTTPIngressPath) netv1.IngressRule {
+	r := netv1.IngressRule{Host: host}
+	if paths != nil {
+		r.HTTP = &netv1.HTTPIngressRuleValue{Paths: paths}
+	}
+	return r
+}
+
+func ingressPathOf(path string, pt *netv1.PathType, backend netv1.IngressBackend) netv1.HTTPIngressPath {
+	return netv1.HTTPIngressPath{Path: path, PathType: pt, Backend: backend}
+}
+
+// routeOf is the route without the parts routes() builds from the
+// S3Backend.
+type routeOf struct {
+	host      string
+	path      string
+	pathType  s3backend.PathType
+	isDefault bool
+}
+
+func routesOf(routes []s3backend.Route) []routeOf {
+	out := []routeOf{}
+	for _, r := range routes {
+		out = append(out, routeOf{host: r.Host, path: r.Path, pathType: r.PathType, isDefault: r.Default})
+	}
+	return out
+}
+
+func TestRoutesHosts(t *testing.T) {
+	ih := newTestIngressHandler("site", "api")
+	prefix := netv1.PathTypePrefix
+	otherGroup := "example.com"
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"},
+		Spec: netv1.IngressSpec{Rules: []netv1.IngressRule{
+			rule("www.example.com",
+				ingressPathOf("/", &prefix, s3Backend("site")),
+				ingressPathOf("/api", &prefix, s3Backend("api")),
+			),
+			rule("*.example.org", ingressPathOf("/", &prefix, s3Backend("site"))),
+			rule("", ingressPathOf("/any", &prefix, s3Backend("site"))),
+			rule("nohttp.example.com"),
+			// paths not backed by an S3Backend are left to others
+			rule("www.example.com",
+				ingressPathOf("/svc", &prefix, netv1.IngressBackend{Service: &netv1.IngressServiceBackend{Name: "svc"}}),
+				ingressPathOf("/other", &prefix, netv1.IngressBackend{Resource: &corev1.TypedLocalObjectReference{Kind: "Bucket", Name: "site"}}),
+				ingressPathOf("/group", &prefix, netv1.IngressBackend{Resource: &corev1.TypedLocalObjectReference{APIGroup: &otherGroup, Kind: "S3Backend", Name: "site"}}),
+				ingressPathOf("/missing", &prefix, s3Backend("missing")),
+			),
+		}},
+	}
+	want := []routeOf{
+		{host: "www.example.com", path: "/", pathType: s3backend.PathTypePrefix},
+		{host: "www.example.com", path: "/api", pathType: s3backend.PathTypePrefix},
+		{host: "*.example.org", path: "/", pathType: s3backend.PathTypePrefix},
+		{host: "", path: "/any", pathType: s3backend.PathTypePrefix},
+	}
+	routes := ih.routes(zerolog.Nop(), ingress)
+	got := routesOf(routes)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("routes\n%v\nwant\n%v", got, want)
+	}
+	for _, r := range routes {
+		if r.Ingress != "ns/ingress" || r.FS == nil {
+			t.Errorf("route %s%s of %q without file system", r.Host, r.Path, r.Ingress)
+		}
+	}
+}
+
+func TestRoutesPathTypes(t *testing.T) {
+	ih := newTestIngressHandler("site")
+	exact, prefix, specific := netv1.PathTypeExact, netv1.PathTypePrefix, netv1.PathTypeImplementationSpecific
+	unknown := netv1.PathType("Regex")
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"},
+		Spec: netv1.IngressSpec{Rules: []netv1.IngressRule{
+			rule("www.example.com",
+				ingressPathOf("/exact", &exact, s3Backend("site")),
+				ingressPathOf("/prefix", &prefix, s3Backend("site")),
+				ingressPathOf("/specific", &specific, s3Backend("site")),
+				ingressPathOf("/unset", nil, s3Backend("site")),
+				ingressPathOf("/unknown", &unknown, s3Backend("site")),
+			),
+		}},
+	}
+	want := []routeOf{
+		{host: "www.example.com", path: "/exact", pathType: s3backend.PathTypeExact},
+		{host: "www.example.com", path: "/prefix", pathType: s3backend.PathTypePrefix},
+		{host: "www.example.com", path: "/specific", pathType: s3backend.PathTypeImplementationSpecific},
+		{host: "www.example.com", path: "/unset", pathType: s3backend.PathTypeImplementationSpecific},
+		{host: "www.example.com", path: "/unknown", pathType: s3backend.PathTypeImplementationSpecific},
+	}
+	if got := routesOf(ih.routes(zerolog.Nop(), ingress)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("routes\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRoutesDefaultBackend(t *testing.T) {
+	ih := newTestIngressHandler("site", "fallback")
+	exact := netv1.PathTypeExact
+	fallback := s3Backend("fallback")
+	tests := []struct {
+		name  string
+		rules []netv1.IngressRule
+		want  []routeOf
+	}{
+		{
+			name: "without rules for every host",
+			want: []routeOf{{host: "", path: "/", pathType: s3backend.PathTypePrefix, isDefault: true}},
+		},
+		{
+			name: "once per rule host",
+			rules: []netv1.IngressRule{
+				rule("a.example.com", ingressPathOf("/index.html", &exact, s3Backend("site"))),
+				rule("b.example.com"),
+				rule("a.example.com", ingressPathOf("/about.html", &exact, s3Backend("site"))),
+			},
+			want: []routeOf{
+				{host: "a.example.com", path: "/index.html", pathType: s3backend.PathTypeExact},
+				{host: "a.example.com", path: "/about.html", pathType: s3backend.PathTypeExact},
+				{host: "a.example.com", path: "/", pathType: s3backend.PathTypePrefix, isDefault: true},
+				{host: "b.example.com", path: "/", pathType: s3backend.PathTypePrefix, isDefault: true},
+			},
+		},
+		{
+			name:  "a rule without host",
+			rules: []netv1.IngressRule{rule("", ingressPathOf("/index.html", &exact, s3Backend("site")))},
+			want: []routeOf{
+				{host: "", path: "/index.html", pathType: s3backend.PathTypeExact},
+				{host: "", path: "/", pathType: s3backend.PathTypePrefix, isDefault: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := &netv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"},
+				Spec:       netv1.IngressSpec{DefaultBackend: &fallback, Rules: tt.rules},
+			}
+			routes := ih.routes(zerolog.Nop(), ingress)
+			if got := routesOf(routes); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("routes\n%v\nwant\n%v", got, tt.want)
+			}
+			for _, path := range getPaths(ingress) {
+				if path.isDefault && path.Backend.Resource.Name != "fallback" {
+					t.Errorf("default path of %q backed by %q", path.host, path.Backend.Resource.Name)
+				}
+			}
+		})
+	}
+
+	// a defaultBackend which is no S3Backend adds no route
+	service := netv1.IngressBackend{Service: &netv1.IngressServiceBackend{Name: "svc"}}
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"},
+		Spec:       netv1.IngressSpec{DefaultBackend: &service},
+	}
+	if routes := ih.routes(zerolog.Nop(), ingress); len(routes) != 0 {
+		t.Errorf("%d routes for a Service defaultBackend", len(routes))
+	}
+}
@@ -0,0 +1,139 @@
+package k8sinformers
+
+import (
+	"strings"
+
+	k8scrds "github.com/mabels/diener/k8s/crds"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func secretFromObj(obj interface{}) (*corev1.Secret, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	secret, ok := obj.(*corev1.Secret)
+	return secret, ok
+}
+
+// secretEventHandler keeps everything loaded from Secrets of the
+// namespace in sync with the cluster.
+func (ih *ingressHandler) secretEventHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := secretFromObj(obj); ok {
+				ih.tlsCerts.SetSecret(secret)
+				ih.reloadSecret(secret.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, oldOk := secretFromObj(oldObj)
+			newSecret, newOk := secretFromObj(newObj)
+			if !oldOk || !newOk || oldSecret.ResourceVersion == newSecret.ResourceVersion {
+				return
+			}
+			ih.tlsCerts.SetSecret(newSecret)
+			ih.reloadSecret(newSecret.Name)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if secret, ok := secretFromObj(obj); ok {
+				ih.tlsCerts.DeleteSecret(secret)
+				ih.reloadSecret(secret.Name)
+			}
+		},
+	}
+}
+
+// secretValue reads a key of a Secret from the informer and remembers
+// that the ingress uses the Secret, so its routes are rebuilt once the
+// Secret changes. Called with managedMutex held.
+func (ih *ingressHandler) secretValue(ingress *netv1.Ingress, ref k8scrds.SecretKeyRef, defaultKey string) ([]byte, bool) {
+	users, found := ih.secretUsers[ref.Name]
+	if !found {
+		users = map[string]bool{}
+		ih.secretUsers[ref.Name] = users
+	}
+	users[ingressKey(ingress)] = true
+
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
+	}
+	log := ih.log.With().Str("secret", ref.Name).Str("key", key).Logger()
+	obj, found, err := ih.secretInformer.GetStore().GetByKey(ingress.Namespace + "/" + ref.Name)
+	if err != nil || !found {
+		log.Warn().Err(err).Msg("secret not found")
+		return nil, false
+	}
+	secret, ok := secretFromObj(obj)
+	if !ok {
+		return nil, false
+	}
+	value, found := secret.Data[key]
+	if !found {
+		log.Warn().Msg("secret key not found")
+	}
+	return value, found
+}
+
+// secretLines reads a Secret key holding one entry per line.
+func (ih *ingressHandler) secretLines(ingress *netv1.Ingress, ref k8scrds.SecretKeyRef, defaultKey string) []string {
+	value, _ := ih.secretValue(ingress, ref, defaultKey)
+	lines := []string{}
+	for _, line := range strings.Split(string(value), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// loadTLSSecrets loads the certificates of the spec.tls entries of the
+// ingress, the Secrets may have been seen before the ingress.
+func (ih *ingressHandler) loadTLSSecrets(ingress *netv1.Ingress) {
+	for _, itls := range ingress.Spec.TLS {
+		if itls.SecretName == "" {
+			continue
+		}
+		obj, found, err := ih.secretInformer.GetStore().GetByKey(ingress.Namespace + "/" + itls.SecretName)
+		if err != nil || !found {
+			ih.log.Warn().Err(err).Str("secret", itls.SecretName).Msg("tls secret not found")
+			continue
+		}
+		if secret, ok := secretFromObj(obj); ok {
+			ih.tlsCerts.SetSecret(secret)
+		}
+	}
+}
+
+// forgetSecrets drops the ingress from the users of all Secrets. Called
+// with managedMutex held.
+func (ih *ingressHandler) forgetSecrets(key string) {
+	for name, users := range ih.secretUsers {
+		delete(users, key)
+		if len(users) == 0 {
+			delete(ih.secretUsers, name)
+		}
+	}
+}
+
+// reloadSecret rebuilds the routes of the ingresses using the Secret.
+func (ih *ingressHandler) reloadSecret(name string) {
+	ih.managedMutex.Lock()
+	defer ih.managedMutex.Unlock()
+	keys := []string{}
+	for key := range ih.secretUsers[name] {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		ingress, managed := ih.managed[key]
+		if !managed {
+			continue
+		}
+		log := ih.log.With().Str("name", ingress.Name).Str("secret", name).Logger()
+		log.Info().Msg("reload routes for changed secret")
+		ih.forgetSecrets(key)
+		ih.replaceRoutes(log, ingress)
+	}
+}
@@ -0,0 +1,160 @@
+package k8sinformers
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	informercorev1 "k8s.io/client-go/informers/core/v1"
+	kubernetes "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// statusPublisher writes the address diener is reachable at into
+// status.loadBalancer of the ingresses it serves. The address is either
+// the one of the --publish-service or the static --publish-status-address.
+// The Service is watched by an informer, publishing asks no API server.
+type statusPublisher struct {
+	kif       kubernetes.Interface
+	ctx       context.Context
+	log       zerolog.Logger
+	service   string
+	addresses []string
+	// services watches the publish Service, nil without one
+	services cache.SharedIndexInformer
+}
+
+func newStatusPublisher(appCtx ctx.AppCtx, kif kubernetes.Interface, log zerolog.Logger) *statusPublisher {
+	sp := &statusPublisher{
+		kif:       kif,
+		ctx:       appCtx.Ctx,
+		log:       log.With().Str("component", "status-publisher").Logger(),
+		service:   appCtx.Cfg.Ingress.PublishService,
+		addresses: appCtx.Cfg.Ingress.PublishStatusAddresses,
+	}
+	if sp.service != "" {
+		ns, name := sp.serviceName()
+		sp.services = informercorev1.NewFilteredServiceInformer(kif, ns, time.Minute, cache.Indexers{}, func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		})
+	}
+	return sp
+}
+
+func (sp *statusPublisher) serviceName() (string, string) {
+	ns, name, found := strings.Cut(sp.service, "/")
+	if !found {
+		return "default", sp.service
+	}
+	return ns, name
+}
+
+// run watches the publish Service until stopCh is closed, changed is
+// called whenever its address may have changed.
+func (sp *statusPublisher) run(stopCh <-chan struct{}, changed func()) {
+	if sp.services == nil {
+		return
+	}
+	sp.services.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { changed() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSvc, oldOk := oldObj.(*corev1.Service)
+			newSvc, newOk := newObj.(*corev1.Service)
+			if oldOk && newOk && reflect.DeepEqual(oldSvc.Status, newSvc.Status) && reflect.DeepEqual(oldSvc.Spec.ExternalIPs, newSvc.Spec.ExternalIPs) {
+				return
+			}
+			changed()
+		},
+		DeleteFunc: func(obj interface{}) { changed() },
+	})
+	go sp.services.Run(stopCh)
+}
+
+// hasSynced reports if the publish Service is known, for
+// cache.WaitForCacheSync.
+func (sp *statusPublisher) hasSynced() bool {
+	return sp.services == nil || sp.services.HasSynced()
+}
+
+func (sp *statusPublisher) enabled() bool {
+	return sp.service != "" || len(sp.addresses) > 0
+}
+
+func toLoadBalancerIngress(address string) netv1.IngressLoadBalancerIngress {
+	if net.ParseIP(address) != nil {
+		return netv1.IngressLoadBalancerIngress{IP: address}
+	}
+	return netv1.IngressLoadBalancerIngress{Hostname: address}
+}
+
+func (sp *statusPublisher) loadBalancer() []netv1.IngressLoadBalancerIngress {
+	lbs := []netv1.IngressLoadBalancerIngress{}
+	for _, address := range sp.addresses {
+		lbs = append(lbs, toLoadBalancerIngress(address))
+	}
+	if sp.services != nil {
+		ns, name := sp.serviceName()
+		obj, found, err := sp.services.GetStore().GetByKey(ns + "/" + name)
+		if err != nil || !found {
+			sp.log.Warn().Err(err).Str("service", sp.service).Msg("publish service not found")
+		} else if svc, ok := obj.(*corev1.Service); ok {
+			for _, lb := range svc.Status.LoadBalancer.Ingress {
+				lbs = append(lbs, netv1.IngressLoadBalancerIngress{IP: lb.IP, Hostname: lb.Hostname})
+			}
+			for _, ip := range svc.Spec.ExternalIPs {
+				lbs = append(lbs, toLoadBalancerIngress(ip))
+			}
+		}
+	}
+	sort.Slice(lbs, func(i, j int) bool {
+		if lbs[i].IP != lbs[j].IP {
+			return lbs[i].IP < lbs[j].IP
+		}
+		return lbs[i].Hostname < lbs[j].Hostname
+	})
+	return lbs
+}
+
+func (sp *statusPublisher) update(ingress *netv1.Ingress, lbs []netv1.IngressLoadBalancerIngress) {
+	if reflect.DeepEqual(ingress.Status.LoadBalancer.Ingress, lbs) {
+		return
+	}
+	log := sp.log.With().Str("name", ingress.Name).Str("namespace", ingress.Namespace).Logger()
+	updated := ingress.DeepCopy()
+	updated.Status.LoadBalancer.Ingress = lbs
+	_, err := sp.kif.NetworkingV1().Ingresses(ingress.Namespace).UpdateStatus(sp.ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error().Err(err).Msg("update status")
+		return
+	}
+	log.Info().Any("loadBalancer", lbs).Msg("update status")
+}
+
+// Publish sets the current address on an accepted ingress.
+func (sp *statusPublisher) Publish(ingress *netv1.Ingress) {
+	if !sp.enabled() {
+		return
+	}
+	lbs := sp.loadBalancer()
+	if len(lbs) == 0 {
+		lbs = nil
+	}
+	sp.update(ingress, lbs)
+}
+
+// Clear removes the address from an ingress diener dropped.
+func (sp *statusPublisher) Clear(ingress *netv1.Ingress) {
+	if !sp.enabled() || len(ingress.Status.LoadBalancer.Ingress) == 0 {
+		return
+	}
+	sp.update(ingress, nil)
+}
@@ -0,0 +1,77 @@
+package k8sinformers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestStatusPublisher(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "diener", Name: "diener"},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: "192.0.2.1"}},
+		}},
+	}
+	ingress := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "ingress"}}
+	kif := fake.NewSimpleClientset(svc, ingress)
+	appCtx := ctx.AppCtx{Ctx: context.Background()}
+	appCtx.Cfg.Ingress.PublishService = "diener/diener"
+	appCtx.Cfg.Ingress.PublishStatusAddresses = []string{"lb.example.com"}
+	sp := newStatusPublisher(appCtx, kif, zerolog.Nop())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	changed := make(chan struct{}, 10)
+	sp.run(stopCh, func() { changed <- struct{}{} })
+	if !cache.WaitForCacheSync(stopCh, sp.hasSynced) {
+		t.Fatal("service informer did not sync")
+	}
+
+	published := func() []netv1.IngressLoadBalancerIngress {
+		t.Helper()
+		got, err := kif.NetworkingV1().Ingresses("ns").Get(context.Background(), "ingress", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Status.LoadBalancer.Ingress
+	}
+	kif.ClearActions()
+	for i := 0; i < 3; i++ {
+		sp.Publish(ingress)
+	}
+	for _, action := range kif.Actions() {
+		if action.GetResource().Resource == "services" {
+			t.Errorf("publish asked the API server for the service: %s", action.GetVerb())
+		}
+	}
+	lbs := published()
+	if len(lbs) != 2 || lbs[0].Hostname != "lb.example.com" || lbs[1].IP != "192.0.2.1" {
+		t.Errorf("published %+v", lbs)
+	}
+
+	<-changed
+	svc = svc.DeepCopy()
+	svc.Status.LoadBalancer.Ingress[0].IP = "192.0.2.2"
+	if _, err := kif.CoreV1().Services("diener").UpdateStatus(context.Background(), svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("address change not noticed")
+	}
+	current, _ := kif.NetworkingV1().Ingresses("ns").Get(context.Background(), "ingress", metav1.GetOptions{})
+	sp.Publish(current)
+	if lbs := published(); len(lbs) != 2 || lbs[1].IP != "192.0.2.2" {
+		t.Errorf("published %+v after the address changed", lbs)
+	}
+}
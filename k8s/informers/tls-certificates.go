@@ -0,0 +1,176 @@
+package k8sinformers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+type tlsEntry struct {
+	hosts  []string
+	secret string
+}
+
+// TLSCertificates selects the certificate for a TLS handshake by SNI from
+// the spec.tls sections of the managed ingresses. The certificates are
+// kept per Secret and replaced whenever the Secret changes, only Secrets
+// referenced by a managed ingress are loaded.
+type TLSCertificates struct {
+	mutex   sync.RWMutex
+	log     zerolog.Logger
+	ingress map[string][]tlsEntry
+	certs   map[string]*tls.Certificate
+	// order keeps the ingress keys sorted for a stable selection
+	order []string
+}
+
+func NewTLSCertificates(log zerolog.Logger) *TLSCertificates {
+	return &TLSCertificates{
+		log:     log.With().Str("component", "tls-certificates").Logger(),
+		ingress: map[string][]tlsEntry{},
+		certs:   map[string]*tls.Certificate{},
+	}
+}
+
+func secretKey(ns, name string) string {
+	return ns + "/" + name
+}
+
+// sortIngress orders the ingress keys after a change of the ingresses
+// and drops the certificates no ingress refers to anymore.
+func (tc *TLSCertificates) sortIngress() {
+	tc.order = tc.order[:0]
+	for key := range tc.ingress {
+		tc.order = append(tc.order, key)
+	}
+	sort.Strings(tc.order)
+	for secret := range tc.certs {
+		if !tc.referenced(secret) {
+			delete(tc.certs, secret)
+		}
+	}
+}
+
+// referenced reports if a spec.tls entry uses the Secret, called with
+// mutex held.
+func (tc *TLSCertificates) referenced(secret string) bool {
+	for _, entries := range tc.ingress {
+		for _, entry := range entries {
+			if entry.secret == secret {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (tc *TLSCertificates) SetIngress(ingress *netv1.Ingress) {
+	entries := []tlsEntry{}
+	for _, itls := range ingress.Spec.TLS {
+		if itls.SecretName == "" {
+			continue
+		}
+		hosts := make([]string, 0, len(itls.Hosts))
+		for _, host := range itls.Hosts {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+		entries = append(entries, tlsEntry{hosts: hosts, secret: secretKey(ingress.Namespace, itls.SecretName)})
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if len(entries) == 0 {
+		delete(tc.ingress, ingressKey(ingress))
+	} else {
+		tc.ingress[ingressKey(ingress)] = entries
+	}
+	tc.sortIngress()
+}
+
+func (tc *TLSCertificates) DeleteIngress(ingress *netv1.Ingress) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	delete(tc.ingress, ingressKey(ingress))
+	tc.sortIngress()
+}
+
+// SetSecret loads the key pair of a kubernetes.io/tls Secret referenced
+// by a managed ingress. Other Secrets are ignored, a Secret which is no
+// longer one of them is dropped.
+func (tc *TLSCertificates) SetSecret(secret *corev1.Secret) {
+	key := secretKey(secret.Namespace, secret.Name)
+	tc.mutex.RLock()
+	referenced := tc.referenced(key)
+	tc.mutex.RUnlock()
+	if secret.Type != corev1.SecretTypeTLS || !referenced {
+		tc.DeleteSecret(secret)
+		return
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		tc.log.Error().Err(err).Str("secret", key).Msg("load key pair")
+		tc.DeleteSecret(secret)
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.certs[key] = &cert
+	tc.log.Info().Str("secret", key).Msg("load key pair")
+}
+
+func (tc *TLSCertificates) DeleteSecret(secret *corev1.Secret) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	delete(tc.certs, secretKey(secret.Namespace, secret.Name))
+}
+
+// GetCertificate is meant for tls.Config, exact hosts win over wildcard
+// hosts which win over spec.tls entries without hosts.
+func (tc *TLSCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+	var found *tls.Certificate
+	best := 0
+	for _, key := range tc.order {
+		for _, entry := range tc.ingress[key] {
+			cert, loaded := tc.certs[entry.secret]
+			if !loaded {
+				continue
+			}
+			rank := 0
+			if len(entry.hosts) == 0 {
+				rank = 1
+			}
+			for _, host := range entry.hosts {
+				rank = max(rank, tlsHostMatch(host, serverName))
+			}
+			if rank > best {
+				found = cert
+				best = rank
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return found, nil
+}
+
+func tlsHostMatch(host, serverName string) int {
+	if host == serverName {
+		return 3
+	}
+	if strings.HasPrefix(host, "*.") {
+		label, rest, found := strings.Cut(serverName, ".")
+		if found && label != "" && rest == host[2:] {
+			return 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package k8sinformers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tlsSecret is a kubernetes.io/tls Secret with a self-signed certificate
+// whose common name is the name of the Secret.
+func tlsSecret(t *testing.T, name string) *corev1.Secret {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+}
+
+func tlsIngress(name string, tls ...netv1.IngressTLS) *netv1.Ingress {
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec:       netv1.IngressSpec{TLS: tls},
+	}
+}
+
+// servedBy is the common name of the certificate selected for the SNI.
+func servedBy(t *testing.T, tc *TLSCertificates, serverName string) string {
+	t.Helper()
+	cert, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSCertificatesSNI(t *testing.T) {
+	tc := NewTLSCertificates(zerolog.Nop())
+	tc.SetIngress(tlsIngress("a",
+		netv1.IngressTLS{Hosts: []string{"www.example.com"}, SecretName: "exact"},
+		netv1.IngressTLS{Hosts: []string{"*.example.com"}, SecretName: "wildcard"},
+	))
+	tc.SetIngress(tlsIngress("b", netv1.IngressTLS{SecretName: "fallback"}))
+	for _, name := range []string{"exact", "wildcard", "fallback"} {
+		tc.SetSecret(tlsSecret(t, name))
+	}
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"www.example.com", "exact"},
+		{"WWW.Example.COM.", "exact"},
+		{"api.example.com", "wildcard"},
+		{"a.b.example.com", "fallback"},
+		{"example.com", "fallback"},
+		{"other.org", "fallback"},
+		{"", "fallback"},
+	}
+	for _, tt := range tests {
+		if got := servedBy(t, tc, tt.serverName); got != tt.want {
+			t.Errorf("%q served by %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+
+	tc.DeleteIngress(tlsIngress("b"))
+	if got := servedBy(t, tc, "other.org"); got != "" {
+		t.Errorf("other.org served by %q after the fallback ingress is gone", got)
+	}
+	if got := servedBy(t, tc, "api.example.com"); got != "wildcard" {
+		t.Errorf("api.example.com served by %q, want wildcard", got)
+	}
+}
+
+func TestTLSCertificatesSecrets(t *testing.T) {
+	tc := NewTLSCertificates(zerolog.Nop())
+	tc.SetSecret(tlsSecret(t, "unused"))
+	if len(tc.certs) != 0 {
+		t.Errorf("loaded %d certificates no ingress refers to", len(tc.certs))
+	}
+
+	tc.SetIngress(tlsIngress("a", netv1.IngressTLS{Hosts: []string{"www.example.com"}, SecretName: "cert"}))
+	secret := tlsSecret(t, "cert")
+	tc.SetSecret(secret)
+	if got := servedBy(t, tc, "www.example.com"); got != "cert" {
+		t.Fatalf("www.example.com served by %q, want cert", got)
+	}
+
+	// a Secret which is no TLS Secret anymore is dropped
+	opaque := secret.DeepCopy()
+	opaque.Type = corev1.SecretTypeOpaque
+	tc.SetSecret(opaque)
+	if got := servedBy(t, tc, "www.example.com"); got != "" {
+		t.Errorf("www.example.com served by %q after the Secret became opaque", got)
+	}
+
+	// a broken key pair drops the old one as well
+	tc.SetSecret(secret)
+	broken := secret.DeepCopy()
+	broken.Data[corev1.TLSPrivateKeyKey] = []byte("broken")
+	tc.SetSecret(broken)
+	if got := servedBy(t, tc, "www.example.com"); got != "" {
+		t.Errorf("www.example.com served by %q after the key broke", got)
+	}
+
+	tc.SetSecret(secret)
+	tc.DeleteIngress(tlsIngress("a"))
+	if len(tc.certs) != 0 {
+		t.Errorf("kept %d certificates after the ingress is gone", len(tc.certs))
+	}
+}
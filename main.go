@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"github.com/mabels/diener/ctx"
 	k8scrds "github.com/mabels/diener/k8s/crds"
 	k8sinformers "github.com/mabels/diener/k8s/informers"
+	"github.com/mabels/diener/middleware"
 
 	"go.opentelemetry.io/otel"
 
@@ -105,11 +108,30 @@ import (
 // }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := signCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	var kubeconfig string
 	pflag.StringVar(&kubeconfig, "kubeconfig", "", "path to Kubernetes config file")
 	var listen string
 	pflag.StringVar(&listen, "listen", ":8282", "listen address")
+	var listenTLS string
+	pflag.StringVar(&listenTLS, "listen-tls", ":8443", "TLS listen address, empty disables TLS")
+	var controllerName string
+	pflag.StringVar(&controllerName, "controller-name", "diener.adviser.com/controller", "IngressClass controller served by diener")
+	var publishService string
+	pflag.StringVar(&publishService, "publish-service", "", "namespace/name of the Service whose address is published on the Ingress status")
+	var publishStatusAddresses []string
+	pflag.StringSliceVar(&publishStatusAddresses, "publish-status-address", nil, "static IPs or hostnames published on the Ingress status")
+	var trustedProxies []string
+	pflag.StringSliceVar(&trustedProxies, "trusted-proxies", nil, "CIDRs of proxies whose forwarded header tells the client IP")
+	var forwardedHeader string
+	pflag.StringVar(&forwardedHeader, "forwarded-header", "x-forwarded-for", "header the trusted proxies write the client IP to: x-forwarded-for or forwarded")
 	var debug bool
 	pflag.BoolVar(&debug, "debug", false, "set debug")
 	pflag.Parse()
@@ -161,7 +183,15 @@ func main() {
 		Meter:  otel.Meter("diener"),
 		Cfg: ctx.Config{
 			HttpConfig: ctx.HttpConfig{
-				Listen: listen,
+				Listen:          listen,
+				ListenTLS:       listenTLS,
+				TrustedProxies:  trustedProxies,
+				ForwardedHeader: forwardedHeader,
+			},
+			Ingress: ctx.IngressConfig{
+				ControllerName:         controllerName,
+				PublishService:         publishService,
+				PublishStatusAddresses: publishStatusAddresses,
 			},
 
 			Ristretto: ristretto.Config{
@@ -169,6 +199,11 @@ func main() {
 				MaxCost:     1 << 30, // maximum cost of cache (1GB).
 				BufferItems: 64,      // number of keys per Get buffer
 			},
+			MetaRistretto: ristretto.Config{
+				NumCounters: 1e6, // number of keys to track frequency of (1M).
+				MaxCost:     1e5, // maximum number of cached object metadata.
+				BufferItems: 64,  // number of keys per Get buffer
+			},
 		},
 		Ctx: octx,
 	}
@@ -188,6 +223,20 @@ func main() {
 		return
 	}
 
+	// HEAD requests only need the metadata of an object, it is cached
+	// apart so it does not push bodies out of the object cache
+	metaCache, err := ristretto.NewCache(&appCtx.Cfg.MetaRistretto)
+	if err != nil {
+		log.Error().Err(err).Msg("new meta cache")
+		return
+	}
+
+	proxies, err := middleware.NewTrustedProxies(appCtx.Cfg.HttpConfig.TrustedProxies, appCtx.Cfg.HttpConfig.ForwardedHeader)
+	if err != nil {
+		log.Error().Err(err).Msg("trusted proxies")
+		return
+	}
+
 	dynamicBackend, err := s3backend.NewDynamicBackend(appCtx.Log)
 	if err != nil {
 		log.Error().Err(err).Msg("new cache")
@@ -221,6 +270,18 @@ func main() {
 	// 	// k8sinformers.NewS3BackendHandler(appCtx),
 	// }
 
+	tlsCerts := k8sinformers.NewTLSCertificates(appCtx.Log)
+
+	classInformer, err := k8sinformers.IngressClassInformer(config, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create ingress class informer")
+	}
+	go classInformer.Run(wait.NeverStop)
+	if !cache.WaitForCacheSync(octx.Done(), classInformer.HasSynced) {
+		log.Error().Msg("ingress class informer not synced")
+		return
+	}
+
 	informer, err := k8sinformers.NamespacedInformer(config, dienerApi, log, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			ns, ok := obj.(*v1.Namespace)
@@ -228,7 +289,7 @@ func main() {
 				log.Warn().Str("func", "AddFunc").Str("type", reflect.TypeOf(obj).Name()).Msg("not a namespace")
 				return
 			}
-			k8sinformers.NewIngressHandlerByNamespace(ns.Name, appCtx, config, dynamicBackend, dienerApi, rcache)
+			k8sinformers.NewIngressHandlerByNamespace(ns.Name, appCtx, config, dynamicBackend, dienerApi, rcache, metaCache, tlsCerts)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			_, oldOk := oldObj.(*v1.Namespace)
@@ -266,13 +327,33 @@ func main() {
 		BaseContext:  func(_ net.Listener) context.Context { return octx },
 		ReadTimeout:  time.Second,
 		WriteTimeout: 10 * time.Second,
-		Handler:      newHTTPHandler(appCtx, dynamicBackend),
+		Handler:      newHTTPHandler(appCtx, dynamicBackend, proxies),
 	}
-	srvErr := make(chan error, 1)
+	srvErr := make(chan error, 2)
 	go func() {
 		srvErr <- srv.ListenAndServe()
 	}()
 
+	var srvTLS *http.Server
+	if appCtx.Cfg.HttpConfig.ListenTLS != "" {
+		log.Debug().Str("listen", appCtx.Cfg.HttpConfig.ListenTLS).Msg("starting tls server")
+		srvTLS = &http.Server{
+			Addr:         appCtx.Cfg.HttpConfig.ListenTLS,
+			BaseContext:  func(_ net.Listener) context.Context { return octx },
+			ReadTimeout:  time.Second,
+			WriteTimeout: 10 * time.Second,
+			Handler:      srv.Handler,
+			TLSConfig: &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: tlsCerts.GetCertificate,
+			},
+		}
+		go func() {
+			// the certificates come from GetCertificate
+			srvErr <- srvTLS.ListenAndServeTLS("", "")
+		}()
+	}
+
 	// Wait for interruption.
 	select {
 	case err = <-srvErr:
@@ -286,6 +367,9 @@ func main() {
 
 	// When Shutdown is called, ListenAndServe immediately returns ErrServerClosed.
 	err = srv.Shutdown(context.Background())
+	if srvTLS != nil {
+		err = errors.Join(err, srvTLS.Shutdown(context.Background()))
+	}
 
 	// err = http.ListenAndServe(appCtx.Cfg.HttpConfig.Listen, http.FileServer(dynamicBackend))
 	// if err != nil {
@@ -294,32 +378,25 @@ func main() {
 }
 
 type MyHttpHandler struct {
-	appCtx ctx.AppCtx
-	db     *s3backend.DynamicBackend
+	appCtx  ctx.AppCtx
+	db      *s3backend.DynamicBackend
+	proxies *middleware.TrustedProxies
 }
 
 func (h MyHttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx, span := h.appCtx.Tracer.Start(req.Context(), req.URL.Path)
 	defer span.End()
-	cdb := h.db.WithContext(ctx)
-	if req.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Max-Age", "3600")
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	origin := "*"
-	if req.Header.Get("Origin") != "" {
-		origin = req.Header.Get("Origin")
-	}
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	http.FileServer(cdb).ServeHTTP(w, req.WithContext(ctx))
+	// the middlewares of the route filter and sign by this client IP
+	ctx = middleware.WithClientIP(ctx, h.proxies.ClientIP(req))
+	cdb := h.db.WithContext(ctx).WithHost(req.Host)
+	// CORS is up to the middlewares of the route
+	cdb.Handler(req).ServeHTTP(w, req.WithContext(ctx))
 }
 
-func newHTTPHandler(appCtx ctx.AppCtx, db *s3backend.DynamicBackend) http.Handler {
+func newHTTPHandler(appCtx ctx.AppCtx, db *s3backend.DynamicBackend, proxies *middleware.TrustedProxies) http.Handler {
 	return MyHttpHandler{
-		appCtx: appCtx,
-		db:     db,
+		appCtx:  appCtx,
+		db:      db,
+		proxies: proxies,
 	}
 }
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is checked for unknown users, so they take as long as the
+// known ones.
+const dummyHash = "$2a$10$R2.p5GBTO/JIMw4cLWezUe8wy/mzS4Sowz3wvZJ/mJNxxVdBxz1ly"
+
+// BasicAuth lets requests of the guarded methods only pass with the
+// credentials of a user of an htpasswd file, all other methods pass as
+// is. Without users every guarded request is refused.
+type BasicAuth struct {
+	log     zerolog.Logger
+	realm   string
+	users   map[string]string
+	methods map[string]bool
+	// verified remembers accepted credentials, browsers send them with
+	// every request and bcrypt is slow on purpose
+	verified sync.Map
+}
+
+// NewBasicAuth reads the htpasswd lines, bcrypt ($2y$) and {SHA} hashes
+// are supported, other entries are skipped.
+func NewBasicAuth(log zerolog.Logger, realm string, htpasswd []string, methods ...string) *BasicAuth {
+	ba := &BasicAuth{
+		log:     log.With().Str("component", "basic-auth").Logger(),
+		realm:   realm,
+		users:   map[string]string{},
+		methods: map[string]bool{},
+	}
+	for _, line := range htpasswd {
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" || strings.HasPrefix(user, "#") {
+			continue
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			ba.log.Warn().Str("user", user).Msg("unsupported htpasswd hash, use bcrypt")
+			continue
+		}
+		ba.users[user] = hash
+	}
+	for _, method := range methods {
+		ba.methods[method] = true
+	}
+	return ba
+}
+
+// valid checks the password against the hash of the user.
+func (ba *BasicAuth) valid(user, password string) bool {
+	hash, found := ba.users[user]
+	if !found {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(sha)) == 1
+	}
+	credentials := sha256.Sum256([]byte(user + "\x00" + password))
+	if v, found := ba.verified.Load(credentials); found && v.(string) == hash {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	ba.verified.Store(credentials, hash)
+	return true
+}
+
+func (ba *BasicAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ba.methods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, password, found := r.BasicAuth()
+		if !found || !ba.valid(user, password) {
+			if found {
+				ba.log.Warn().Str("user", user).Str("path", r.URL.Path).Msg("invalid credentials")
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.ReplaceAll(ba.realm, `"`, "")+`", charset="UTF-8"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
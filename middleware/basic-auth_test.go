@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptLine(t *testing.T, user, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash)
+}
+
+func shaLine(user, password string) string {
+	sum := sha1.Sum([]byte(password))
+	return user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// basicStatus is the status of a request with the credentials through ba,
+// without credentials for an empty user.
+func basicStatus(ba *BasicAuth, method, user, password string) (int, http.Header) {
+	r := httptest.NewRequest(method, "/file.pdf", nil)
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	ba.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	return w.Code, w.Header()
+}
+
+func TestBasicAuth(t *testing.T) {
+	ba := NewBasicAuth(zerolog.Nop(), `my "realm"`, []string{
+		"# comment",
+		"",
+		"nocolon",
+		":nouser",
+		bcryptLine(t, "alice", "wonderland"),
+		shaLine("bob", "builder"),
+		"carol:$apr1$salt$0123456789abcdefghijkl",
+		"dave:plain",
+	}, http.MethodGet, http.MethodPut)
+	if len(ba.users) != 2 {
+		t.Errorf("%d users, want alice and bob only: %v", len(ba.users), ba.users)
+	}
+	tests := []struct {
+		name     string
+		method   string
+		user     string
+		password string
+		status   int
+	}{
+		{name: "bcrypt", method: http.MethodGet, user: "alice", password: "wonderland", status: http.StatusOK},
+		{name: "bcrypt again", method: http.MethodPut, user: "alice", password: "wonderland", status: http.StatusOK},
+		{name: "bcrypt wrong password", method: http.MethodGet, user: "alice", password: "wonder", status: http.StatusUnauthorized},
+		{name: "sha", method: http.MethodGet, user: "bob", password: "builder", status: http.StatusOK},
+		{name: "sha wrong password", method: http.MethodGet, user: "bob", password: "build", status: http.StatusUnauthorized},
+		{name: "md5 skipped", method: http.MethodGet, user: "carol", password: "x", status: http.StatusUnauthorized},
+		{name: "plain skipped", method: http.MethodGet, user: "dave", password: "plain", status: http.StatusUnauthorized},
+		{name: "unknown user", method: http.MethodGet, user: "eve", password: "wonderland", status: http.StatusUnauthorized},
+		{name: "no credentials", method: http.MethodGet, status: http.StatusUnauthorized},
+		{name: "unguarded method", method: http.MethodDelete, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, header := basicStatus(ba, tt.method, tt.user, tt.password)
+			if status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+			challenge := header.Get("WWW-Authenticate")
+			if tt.status == http.StatusUnauthorized && challenge != `Basic realm="my realm", charset="UTF-8"` {
+				t.Errorf("challenge %q", challenge)
+			}
+			if tt.status != http.StatusUnauthorized && challenge != "" {
+				t.Errorf("challenge %q on %d", challenge, status)
+			}
+		})
+	}
+}
+
+// TestBasicAuthReload checks that the credentials of a reloaded htpasswd
+// Secret apply, even for credentials accepted before.
+func TestBasicAuthReload(t *testing.T) {
+	old := NewBasicAuth(zerolog.Nop(), "realm", []string{bcryptLine(t, "alice", "old")}, http.MethodGet)
+	if status, _ := basicStatus(old, http.MethodGet, "alice", "old"); status != http.StatusOK {
+		t.Fatalf("status %d with the old password", status)
+	}
+	reloaded := NewBasicAuth(zerolog.Nop(), "realm", []string{bcryptLine(t, "alice", "new")}, http.MethodGet)
+	if status, _ := basicStatus(reloaded, http.MethodGet, "alice", "old"); status != http.StatusUnauthorized {
+		t.Errorf("status %d with the old password after reload", status)
+	}
+	if status, _ := basicStatus(reloaded, http.MethodGet, "alice", "new"); status != http.StatusOK {
+		t.Errorf("status %d with the new password after reload", status)
+	}
+
+	// a user dropped from the file is refused
+	emptied := NewBasicAuth(zerolog.Nop(), "realm", nil, http.MethodGet)
+	if status, _ := basicStatus(emptied, http.MethodGet, "alice", "new"); status != http.StatusUnauthorized {
+		t.Errorf("status %d for a removed user", status)
+	}
+}
+
+// TestBasicAuthVerifiedHash checks that a remembered verification only
+// holds for the hash it was made against.
+func TestBasicAuthVerifiedHash(t *testing.T) {
+	ba := NewBasicAuth(zerolog.Nop(), "realm", []string{bcryptLine(t, "alice", "old")}, http.MethodGet)
+	if !ba.valid("alice", "old") {
+		t.Fatal("old password refused")
+	}
+	_, hash, _ := strings.Cut(bcryptLine(t, "alice", "new"), ":")
+	ba.users["alice"] = hash
+	if ba.valid("alice", "old") {
+		t.Error("old password accepted against the new hash")
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// BearerAuth lets requests of the guarded methods only pass with one of
+// the tokens in the Authorization header, all other methods pass as is.
+// Without tokens every guarded request is refused.
+type BearerAuth struct {
+	log     zerolog.Logger
+	tokens  [][]byte
+	methods map[string]bool
+	// basicRealm is set if the token may also be the password of Basic
+	// credentials
+	basicRealm string
+}
+
+func NewBearerAuth(log zerolog.Logger, tokens []string, methods ...string) *BearerAuth {
+	ba := &BearerAuth{
+		log:     log.With().Str("component", "bearer-auth").Logger(),
+		methods: map[string]bool{},
+	}
+	for _, token := range tokens {
+		if token != "" {
+			ba.tokens = append(ba.tokens, []byte(token))
+		}
+	}
+	for _, method := range methods {
+		ba.methods[method] = true
+	}
+	return ba
+}
+
+// AcceptBasic also takes a token as password of Basic credentials with
+// any user name, WebDAV clients cannot send anything else. Refused
+// requests are challenged for Basic credentials of the realm then.
+func (ba *BearerAuth) AcceptBasic(realm string) *BearerAuth {
+	ba.basicRealm = realm
+	return ba
+}
+
+// bearerToken is the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func (ba *BearerAuth) valid(token string) bool {
+	valid := 0
+	for _, t := range ba.tokens {
+		// compare against every token so the timing tells nothing
+		valid |= subtle.ConstantTimeCompare(t, []byte(token))
+	}
+	return valid == 1
+}
+
+// challenge refuses the request, bearerError is added to a Bearer
+// challenge.
+func (ba *BearerAuth) challenge(w http.ResponseWriter, bearerError string) {
+	if ba.basicRealm != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.ReplaceAll(ba.basicRealm, `"`, "")+`", charset="UTF-8"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="diener"`+bearerError)
+	}
+	http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+}
+
+func (ba *BearerAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ba.methods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := bearerToken(r)
+		if !found && ba.basicRealm != "" {
+			_, token, found = r.BasicAuth()
+		}
+		if !found {
+			ba.challenge(w, "")
+			return
+		}
+		if !ba.valid(token) {
+			ba.log.Warn().Str("method", r.Method).Str("path", r.URL.Path).Msg("invalid token")
+			ba.challenge(w, `, error="invalid_token"`)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBearerAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		basic     bool
+		method    string
+		auth      func(r *http.Request)
+		status    int
+		challenge string
+	}{
+		{
+			name:   "read passes",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:      "write without token",
+			method:    http.MethodPut,
+			status:    http.StatusUnauthorized,
+			challenge: "Bearer",
+		},
+		{
+			name:   "write with token",
+			method: http.MethodPut,
+			auth:   func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			status: http.StatusOK,
+		},
+		{
+			name:      "write with other token",
+			method:    http.MethodPut,
+			auth:      func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") },
+			status:    http.StatusUnauthorized,
+			challenge: "Bearer",
+		},
+		{
+			name:      "basic refused without AcceptBasic",
+			method:    http.MethodPut,
+			auth:      func(r *http.Request) { r.SetBasicAuth("user", "secret") },
+			status:    http.StatusUnauthorized,
+			challenge: "Bearer",
+		},
+		{
+			name:   "basic with token as password",
+			basic:  true,
+			method: "MKCOL",
+			auth:   func(r *http.Request) { r.SetBasicAuth("anyone", "secret") },
+			status: http.StatusOK,
+		},
+		{
+			name:   "bearer with AcceptBasic",
+			basic:  true,
+			method: "MKCOL",
+			auth:   func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			status: http.StatusOK,
+		},
+		{
+			name:      "basic with other password",
+			basic:     true,
+			method:    "MKCOL",
+			auth:      func(r *http.Request) { r.SetBasicAuth("anyone", "guess") },
+			status:    http.StatusUnauthorized,
+			challenge: `Basic realm="files"`,
+		},
+		{
+			name:      "basic challenge without credentials",
+			basic:     true,
+			method:    "MKCOL",
+			status:    http.StatusUnauthorized,
+			challenge: `Basic realm="files"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ba := NewBearerAuth(zerolog.Nop(), []string{"", "secret"}, http.MethodPut, "MKCOL")
+			if tt.basic {
+				ba.AcceptBasic("files")
+			}
+			r := httptest.NewRequest(tt.method, "/file", nil)
+			if tt.auth != nil {
+				tt.auth(r)
+			}
+			w := httptest.NewRecorder()
+			ba.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, tt.challenge) || (tt.challenge == "") != (got == "") {
+				t.Errorf("challenge %q, want %q", got, tt.challenge)
+			}
+		})
+	}
+}
+
+func TestBearerAuthWithoutTokens(t *testing.T) {
+	ba := NewBearerAuth(zerolog.Nop(), []string{""}, http.MethodPut).AcceptBasic("files")
+	r := httptest.NewRequest(http.MethodPut, "/file", nil)
+	r.SetBasicAuth("anyone", "")
+	w := httptest.NewRecorder()
+	ba.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// WithClientIP keeps the client IP derived for the request in ctx.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP is the address of the client which sent the request, as
+// derived by TrustedProxies or else the remote address.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parsePrefix reads a CIDR or a single IP.
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if strings.Contains(cidr, "/") {
+		prefix, err := netip.ParsePrefix(cidr)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies derives the client IP of requests which reach diener
+// through proxies. Only the hops added by trusted proxies are believed,
+// the forwarded addresses are walked from the nearest hop to the first
+// untrusted one. Only the header the proxies write is read, the other
+// one comes from the client as it is.
+type TrustedProxies struct {
+	prefixes  []netip.Prefix
+	forwarded bool
+}
+
+// NewTrustedProxies reads the client IPs from header, "x-forwarded-for"
+// or "forwarded", "" is the former.
+func NewTrustedProxies(cidrs []string, header string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	switch strings.ToLower(header) {
+	case "", "x-forwarded-for":
+	case "forwarded":
+		tp.forwarded = true
+	default:
+		return nil, fmt.Errorf("unknown forwarded header %q", header)
+	}
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		tp.prefixes = append(tp.prefixes, prefix)
+	}
+	return tp, nil
+}
+
+// forwardedFor are the client addresses of the Forwarded header.
+func forwardedFor(r *http.Request) []string {
+	hops := []string{}
+	for _, element := range strings.Split(strings.Join(r.Header.Values("Forwarded"), ","), ",") {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(key, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		// "[2001:db8::1]:4711" and "192.0.2.1:4711" carry a port
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		hops = append(hops, strings.Trim(hop, "[]"))
+	}
+	return hops
+}
+
+// xForwardedFor are the client addresses of the X-Forwarded-For header.
+func xForwardedFor(r *http.Request) []string {
+	hops := []string{}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// hops are the forwarded addresses of the header the proxies write, the
+// nearest hop last.
+func (tp *TrustedProxies) hops(r *http.Request) []string {
+	if tp.forwarded {
+		return forwardedFor(r)
+	}
+	return xForwardedFor(r)
+}
+
+// ClientIP is the remote address, or if it is a trusted proxy the first
+// untrusted forwarded address from the nearest hop on. A hop which is no
+// IP, like "unknown", ends the walk at the proxy which added it.
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if !containsAddr(tp.prefixes, addr) {
+		return addr.String()
+	}
+	hops := tp.hops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !containsAddr(tp.prefixes, addr) {
+			break
+		}
+	}
+	return addr.String()
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		xff        []string
+		forwarded  string
+		want       string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "192.0.2.1:4711",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "untrusted peer spoofs x-forwarded-for",
+			remoteAddr: "192.0.2.1:4711",
+			xff:        []string{"10.0.0.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "untrusted peer spoofs forwarded",
+			header:     "forwarded",
+			remoteAddr: "192.0.2.1:4711",
+			forwarded:  "for=10.0.0.1",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "one trusted proxy",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "client prepends a spoofed hop",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"203.0.113.9, 198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "walks trusted hops over several headers",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"203.0.113.9, 198.51.100.7", "10.0.0.2"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "invalid hop stops at the proxy",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"198.51.100.7, unknown"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "all hops trusted",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "x-forwarded-for ignored when forwarded is configured",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:4711",
+			xff:        []string{"203.0.113.9"},
+			forwarded:  `for="[2001:db8::1]:4711";proto=https`,
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "forwarded ignored when x-forwarded-for is configured",
+			remoteAddr: "10.0.0.1:4711",
+			forwarded:  "for=203.0.113.9",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "forwarded with several elements",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:4711",
+			forwarded:  "for=203.0.113.9, for=198.51.100.7:80, for=10.0.0.2",
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "mapped IPv4 peer",
+			remoteAddr: "[::ffff:10.0.0.1]:4711",
+			xff:        []string{"198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp, err := NewTrustedProxies([]string{"10.0.0.0/8"}, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("Forwarded", tt.forwarded)
+			}
+			if got := tp.ClientIP(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := NewTrustedProxies(nil, "x-real-ip"); err == nil {
+		t.Error("unknown header accepted")
+	}
+}
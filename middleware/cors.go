@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+// CORS answers preflight requests and adds the CORS headers to the
+// responses of the allowed origins. Requests of other origins are passed
+// on without CORS headers so the browser blocks them.
+type CORS struct {
+	log              zerolog.Logger
+	origins          []string
+	methods          []string
+	headers          []string
+	exposeHeaders    string
+	allowCredentials bool
+	// wildcard is set if "*" allows every origin
+	wildcard bool
+	maxAge   string
+}
+
+// NewCORS builds the policy, without methods GET and HEAD are allowed.
+func NewCORS(log zerolog.Logger, cfg ctx.CORSConfig) *CORS {
+	c := &CORS{
+		log:              log.With().Str("component", "cors").Logger(),
+		methods:          []string{http.MethodGet, http.MethodHead},
+		exposeHeaders:    strings.Join(cfg.ExposeHeaders, ", "),
+		allowCredentials: cfg.AllowCredentials,
+	}
+	for _, origin := range cfg.AllowOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		c.wildcard = c.wildcard || origin == "*"
+		c.origins = append(c.origins, origin)
+	}
+	if c.wildcard && c.allowCredentials {
+		// credentials for every origin would let any site read as the user
+		c.log.Warn().Msg("cors allowCredentials ignored with origin *")
+		c.allowCredentials = false
+	}
+	if len(cfg.AllowMethods) > 0 {
+		c.methods = nil
+		for _, method := range cfg.AllowMethods {
+			c.methods = append(c.methods, strings.ToUpper(method))
+		}
+	}
+	for _, header := range cfg.AllowHeaders {
+		c.headers = append(c.headers, http.CanonicalHeaderKey(header))
+	}
+	if cfg.MaxAgeSeconds > 0 {
+		c.maxAge = strconv.Itoa(cfg.MaxAgeSeconds)
+	}
+	return c
+}
+
+// matchOrigin matches an origin against an allowed one, "*" matches every
+// origin and "https://*.example.com" every subdomain of example.com.
+func matchOrigin(allowed, origin string) bool {
+	if allowed == "*" || allowed == origin {
+		return true
+	}
+	prefix, suffix, found := strings.Cut(allowed, "*.")
+	if !found {
+		return false
+	}
+	host, ok := strings.CutPrefix(origin, prefix)
+	if !ok {
+		return false
+	}
+	sub, ok := strings.CutSuffix(host, "."+suffix)
+	return ok && sub != "" && !strings.ContainsAny(sub, "/:")
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowsMethod(method string) bool {
+	for _, allowed := range c.methods {
+		if allowed == "*" || allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders checks the comma separated headers of a preflight.
+func (c *CORS) allowsHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, h := range c.headers {
+			if h == "*" || h == header {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin sets the origin the response is shared with, the wildcard
+// is answered if the policy is open to all origins, which never
+// involves credentials.
+func (c *CORS) allowOrigin(w http.ResponseWriter, origin string) {
+	if c.wildcard {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || method == "" {
+			if c.allowsOrigin(origin) {
+				c.allowOrigin(w, origin)
+				if c.exposeHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", c.exposeHeaders)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		headers := r.Header.Get("Access-Control-Request-Headers")
+		if !c.allowsOrigin(origin) || !c.allowsMethod(method) || !c.allowsHeaders(headers) {
+			c.log.Debug().Str("origin", origin).Str("method", method).Str("headers", headers).Msg("preflight rejected")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c.allowOrigin(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.maxAge != "" {
+			w.Header().Set("Access-Control-Max-Age", c.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+func TestCORS(t *testing.T) {
+	restricted := ctx.CORSConfig{
+		AllowOrigins:     []string{"https://app.example.com/", "https://*.example.org"},
+		AllowMethods:     []string{"get", "put"},
+		AllowHeaders:     []string{"authorization", "x-requested-with"},
+		ExposeHeaders:    []string{"ETag", "Content-Range"},
+		AllowCredentials: true,
+		MaxAgeSeconds:    600,
+	}
+	open := ctx.CORSConfig{
+		AllowOrigins:     []string{"*"},
+		AllowHeaders:     []string{"*"},
+		AllowCredentials: true,
+	}
+	tests := []struct {
+		name   string
+		cfg    ctx.CORSConfig
+		method string
+		header map[string]string
+		status int
+		want   map[string]string
+		vary   []string
+	}{
+		{
+			name:   "no origin",
+			cfg:    restricted,
+			method: http.MethodGet,
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "allowed origin",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://app.example.com"},
+			status: http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "ETag, Content-Range",
+			},
+			vary: []string{"Origin"},
+		},
+		{
+			name:   "other origin passes without headers",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://evil.com"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "subdomain",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://A.b.Example.org"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": "https://A.b.Example.org"},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "wildcard needs a subdomain",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://example.org"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "wildcard does not match a suffix",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://evilexample.org"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "wildcard keeps the scheme",
+			cfg:    restricted,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "http://a.example.org"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "preflight",
+			cfg:    restricted,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "PUT",
+				"Access-Control-Request-Headers": "Authorization, x-requested-with",
+			},
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, PUT",
+				"Access-Control-Allow-Headers":     "Authorization, x-requested-with",
+				"Access-Control-Max-Age":           "600",
+			},
+			vary: []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:   "preflight of another origin",
+			cfg:    restricted,
+			method: http.MethodOptions,
+			header: map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "GET"},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+			vary:   []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:   "preflight of another method",
+			cfg:    restricted,
+			method: http.MethodOptions,
+			header: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name:   "preflight of another header",
+			cfg:    restricted,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "authorization, x-secret",
+			},
+			status: http.StatusForbidden,
+			want:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "options without request method is no preflight",
+			cfg:    restricted,
+			method: http.MethodOptions,
+			header: map[string]string{"Origin": "https://app.example.com"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Methods": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "wildcard drops credentials",
+			cfg:    open,
+			method: http.MethodGet,
+			header: map[string]string{"Origin": "https://any.site"},
+			status: http.StatusOK,
+			want:   map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": ""},
+			vary:   []string{"Origin"},
+		},
+		{
+			name:   "wildcard preflight",
+			cfg:    open,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://any.site",
+				"Access-Control-Request-Method":  "HEAD",
+				"Access-Control-Request-Headers": "x-anything",
+			},
+			status: http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Allow-Methods":     "GET, HEAD",
+				"Access-Control-Allow-Headers":     "x-anything",
+				"Access-Control-Max-Age":           "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewCORS(zerolog.Nop(), tt.cfg).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(tt.method, "/file.pdf", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			for k, v := range tt.want {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s %q, want %q", k, got, v)
+				}
+			}
+			if tt.vary != nil {
+				got := w.Header().Values("Vary")
+				if len(got) != len(tt.vary) {
+					t.Fatalf("Vary %q, want %q", got, tt.vary)
+				}
+				for i := range got {
+					if got[i] != tt.vary[i] {
+						t.Errorf("Vary %q, want %q", got, tt.vary)
+					}
+				}
+			}
+		})
+	}
+}
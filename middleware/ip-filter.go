@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+// IPFilter refuses clients of the deny networks and, if there are allow
+// networks, every client outside of them.
+type IPFilter struct {
+	log        zerolog.Logger
+	allow      []netip.Prefix
+	deny       []netip.Prefix
+	restricted bool
+}
+
+// NewIPFilter skips invalid entries, an allow list of invalid entries
+// alone still refuses everyone.
+func NewIPFilter(log zerolog.Logger, cfg ctx.IPFilterConfig) *IPFilter {
+	f := &IPFilter{
+		log:        log.With().Str("component", "ip-filter").Logger(),
+		restricted: len(cfg.Allow) > 0,
+	}
+	parse := func(cidrs []string) []netip.Prefix {
+		prefixes := []netip.Prefix{}
+		for _, cidr := range cidrs {
+			prefix, err := parsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				f.log.Warn().Err(err).Str("cidr", cidr).Msg("skip invalid cidr")
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		return prefixes
+	}
+	f.allow = parse(cfg.Allow)
+	f.deny = parse(cfg.Deny)
+	return f
+}
+
+func (f *IPFilter) allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return !f.restricted || containsAddr(f.allow, addr)
+}
+
+func (f *IPFilter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := ClientIP(r); !f.allowed(ip) {
+			f.log.Info().Str("ip", ip).Str("path", r.URL.Path).Msg("refused")
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{name: "open", ip: "192.0.2.1", want: true},
+		{name: "denied", deny: []string{"192.0.2.0/24"}, ip: "192.0.2.1"},
+		{name: "allowed", allow: []string{"192.0.2.0/24"}, ip: "192.0.2.1", want: true},
+		{name: "not allowed", allow: []string{"192.0.2.0/24"}, ip: "198.51.100.1"},
+		{name: "deny wins", allow: []string{"192.0.2.0/24"}, deny: []string{"192.0.2.1"}, ip: "192.0.2.1"},
+		{name: "mapped", allow: []string{"192.0.2.1"}, ip: "::ffff:192.0.2.1", want: true},
+		{name: "only invalid allow entries", allow: []string{"nonsense"}, ip: "192.0.2.1"},
+		{name: "no ip", ip: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewIPFilter(zerolog.Nop(), ctx.IPFilterConfig{Allow: tt.allow, Deny: tt.deny})
+			if got := f.allowed(tt.ip); got != tt.want {
+				t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// jwksRefresh is how long fetched keys are used before asking again
+	jwksRefresh = time.Hour
+	// jwksMinRefresh keeps tokens with unknown key ids from making diener
+	// fetch the JWKS on every request
+	jwksMinRefresh = time.Minute
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey is the key in the form the JWT library verifies with.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// parseJWKS reads the signature keys of a JWKS by key id, keys which
+// cannot be used are skipped.
+func parseJWKS(log zerolog.Logger, data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("kid", k.Kid).Msg("skip jwk")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// JWKS are the keys JWTs are verified with, either given once or fetched
+// from a URL and refreshed.
+type JWKS struct {
+	log     zerolog.Logger
+	url     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// fetching is closed once the running fetch is done, nil without one
+	fetching chan struct{}
+}
+
+// NewStaticJWKS holds the keys of the JWKS document.
+func NewStaticJWKS(log zerolog.Logger, data []byte) (*JWKS, error) {
+	log = log.With().Str("component", "jwks").Logger()
+	keys, err := parseJWKS(log, data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{log: log, keys: keys}, nil
+}
+
+// NewRemoteJWKS fetches the keys from the URL when they are first needed.
+func NewRemoteJWKS(log zerolog.Logger, url string) *JWKS {
+	return &JWKS{
+		log:    log.With().Str("component", "jwks").Str("url", url).Logger(),
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]crypto.PublicKey{},
+	}
+}
+
+// fetch replaces the keys with the ones of the URL, on failure the old
+// keys stay. The request runs without holding mu, done is closed at the
+// end.
+func (j *JWKS) fetch(done chan struct{}) {
+	keys := j.download()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if keys != nil {
+		j.keys = keys
+	}
+	j.fetching = nil
+	close(done)
+}
+
+func (j *JWKS) download() map[string]crypto.PublicKey {
+	res, err := j.client.Get(j.url)
+	if err != nil {
+		j.log.Error().Err(err).Msg("fetch jwks")
+		return nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		j.log.Error().Int("status", res.StatusCode).Msg("fetch jwks")
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		j.log.Error().Err(err).Msg("read jwks")
+		return nil
+	}
+	keys, err := parseJWKS(j.log, data)
+	if err != nil {
+		j.log.Error().Err(err).Msg("parse jwks")
+		return nil
+	}
+	j.log.Info().Int("keys", len(keys)).Msg("fetched jwks")
+	return keys
+}
+
+// refresh starts a fetch in the background once the keys are due, a key
+// id not known yet makes them due sooner. Requests go on with the keys
+// they have, only the one with the unknown key id waits for the fetch.
+func (j *JWKS) refresh(kid string) {
+	j.mu.Lock()
+	_, known := j.keys[kid]
+	if kid == "" && len(j.keys) == 1 {
+		known = true
+	}
+	age := time.Since(j.fetched)
+	if j.fetching == nil && (age > jwksRefresh || (!known && age > jwksMinRefresh)) {
+		j.fetched = time.Now()
+		j.fetching = make(chan struct{})
+		go j.fetch(j.fetching)
+	}
+	wait := j.fetching
+	j.mu.Unlock()
+	if !known && wait != nil {
+		<-wait
+	}
+}
+
+// key is the key with the id, a JWT without key id can only use the only
+// key of the set.
+func (j *JWKS) key(kid string) (crypto.PublicKey, error) {
+	if j.url != "" {
+		j.refresh(kid)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	key, found := j.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// jwksServer serves a JWKS which can be swapped, counting the fetches.
+// With block set a fetch waits until it is closed.
+type jwksServer struct {
+	mu      sync.Mutex
+	doc     []byte
+	status  int
+	fetches int
+	block   chan struct{}
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.fetches++
+	doc, status, block := s.doc, s.status, s.block
+	s.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	w.Write(doc)
+}
+
+func (s *jwksServer) set(doc []byte, status int, block chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.doc, s.status, s.block = doc, status, block
+}
+
+func (s *jwksServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// age makes the keys of j look fetched d ago.
+func age(j *JWKS, d time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetched = time.Now().Add(-d)
+}
+
+func TestRemoteJWKSRefresh(t *testing.T) {
+	k1, k2 := newTestKey(t, "k1"), newTestKey(t, "k2")
+	s := &jwksServer{doc: jwksOf(k1)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	j := NewRemoteJWKS(zerolog.Nop(), srv.URL)
+
+	if _, err := j.key("k1"); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+	if _, err := j.key(""); err != nil {
+		t.Errorf("token without kid and a single key: %v", err)
+	}
+	if s.count() != 1 {
+		t.Fatalf("%d fetches, want 1", s.count())
+	}
+
+	// the provider rotates, an unknown kid only refetches after jwksMinRefresh
+	s.set(jwksOf(k1, k2), 0, nil)
+	if _, err := j.key("k2"); err == nil {
+		t.Error("k2 known before the keys were fetched again")
+	}
+	if s.count() != 1 {
+		t.Errorf("%d fetches right after the first, want 1", s.count())
+	}
+	age(j, 2*jwksMinRefresh)
+	if _, err := j.key("k2"); err != nil {
+		t.Errorf("k2 after refetch: %v", err)
+	}
+	if s.count() != 2 {
+		t.Errorf("%d fetches, want 2", s.count())
+	}
+
+	// a failing fetch keeps the keys
+	s.set(nil, http.StatusInternalServerError, nil)
+	age(j, 2*jwksRefresh)
+	if _, err := j.key("k3"); err == nil {
+		t.Error("unknown k3 accepted")
+	}
+	if _, err := j.key("k1"); err != nil {
+		t.Errorf("k1 after failed fetch: %v", err)
+	}
+}
+
+// TestRemoteJWKSBackground checks that a due refresh does not hold up
+// requests whose key is known.
+func TestRemoteJWKSBackground(t *testing.T) {
+	k1 := newTestKey(t, "k1")
+	s := &jwksServer{doc: jwksOf(k1)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	j := NewRemoteJWKS(zerolog.Nop(), srv.URL)
+	if _, err := j.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	s.set(jwksOf(k1), 0, block)
+	age(j, 2*jwksRefresh)
+	done := make(chan error)
+	go func() {
+		_, err := j.key("k1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("k1 during refresh: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("known key waited for the refresh")
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+// jwtMethods are the asymmetric algorithms a JWKS can verify, HMAC is
+// left out so a public key can never be used as shared secret.
+var jwtMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// JWTAuth lets requests of the guarded methods only pass with a bearer
+// JWT of the issuer for the audience. With prefix rules the token also
+// has to allow the key below the mount point of the route. Without keys
+// every guarded request is refused.
+type JWTAuth struct {
+	log        zerolog.Logger
+	jwks       *JWKS
+	parser     *jwt.Parser
+	prefixes   []ctx.JWTPrefixRule
+	mountPoint string
+	methods    map[string]bool
+}
+
+func NewJWTAuth(log zerolog.Logger, cfg ctx.JWTConfig, mountPoint string, methods ...string) *JWTAuth {
+	ja := &JWTAuth{
+		log:        log.With().Str("component", "jwt-auth").Logger(),
+		prefixes:   cfg.Prefixes,
+		mountPoint: mountPoint,
+		methods:    map[string]bool{},
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(jwtMethods),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(cfg.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(30*time.Second),
+		),
+	}
+	for _, method := range methods {
+		ja.methods[method] = true
+	}
+	switch {
+	case cfg.Issuer == "" || cfg.Audience == "":
+		ja.log.Error().Msg("jwt needs issuer and audience, all tokens are refused")
+	case len(cfg.JWKS) > 0:
+		jwks, err := NewStaticJWKS(log, cfg.JWKS)
+		if err != nil {
+			ja.log.Error().Err(err).Msg("parse jwks, all tokens are refused")
+			break
+		}
+		ja.jwks = jwks
+	case cfg.JWKSURL != "":
+		ja.jwks = NewRemoteJWKS(log, cfg.JWKSURL)
+	default:
+		ja.log.Error().Msg("jwt without jwks, all tokens are refused")
+	}
+	return ja
+}
+
+func (ja *JWTAuth) claims(token string) (jwt.MapClaims, error) {
+	if ja.jwks == nil {
+		return nil, fmt.Errorf("no keys")
+	}
+	claims := jwt.MapClaims{}
+	_, err := ja.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return ja.jwks.key(kid)
+	})
+	return claims, err
+}
+
+// claimValues are the string values of the claim, a single one or the
+// ones of a list.
+func claimValues(claims jwt.MapClaims, claim string) []string {
+	switch v := claims[claim].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// allowedPrefixes are the key prefixes the claims match a rule for.
+func (ja *JWTAuth) allowedPrefixes(claims jwt.MapClaims) []string {
+	allowed := []string{}
+	for _, rule := range ja.prefixes {
+		for _, value := range claimValues(claims, rule.Claim) {
+			if rule.Value != "" && value != rule.Value {
+				continue
+			}
+			if value == "" || value == "." || value == ".." || strings.Contains(value, "/") {
+				// a value must not reach out of its prefix or drop it
+				continue
+			}
+			for _, prefix := range rule.Prefixes {
+				allowed = append(allowed, strings.TrimPrefix(strings.ReplaceAll(prefix, "{value}", value), "/"))
+			}
+		}
+	}
+	return allowed
+}
+
+// key is the cleaned request path below the mount point of the route.
+func (ja *JWTAuth) key(r *http.Request) string {
+	name := path.Clean("/" + r.URL.Path)
+	return strings.TrimPrefix(strings.TrimPrefix(name, ja.mountPoint), "/")
+}
+
+func (ja *JWTAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ja.methods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := bearerToken(r)
+		if !found {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="diener"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := ja.claims(token)
+		if err != nil {
+			ja.log.Info().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("invalid token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="diener", error="invalid_token"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if len(ja.prefixes) > 0 {
+			key := ja.key(r)
+			allowed := false
+			for _, prefix := range ja.allowedPrefixes(claims) {
+				// the directory of a prefix itself may be listed
+				if strings.HasPrefix(key+"/", prefix) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				sub, _ := claims.GetSubject()
+				ja.log.Info().Str("sub", sub).Str("key", key).Msg("key not allowed")
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+)
+
+// testKey is an Ed25519 key of a JWKS with its key id.
+type testKey struct {
+	kid     string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func newTestKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, private: private, public: public}
+}
+
+// jwksOf is the JWKS document of the keys.
+func jwksOf(keys ...testKey) []byte {
+	doc := `{"keys":[`
+	for i, k := range keys {
+		if i > 0 {
+			doc += ","
+		}
+		doc += fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","use":"sig","kid":%q,"x":%q}`,
+			k.kid, base64.RawURLEncoding.EncodeToString(k.public))
+	}
+	return []byte(doc + `]}`)
+}
+
+func (k testKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims are the claims of a token the test config accepts, with
+// the extra claims added.
+func validClaims(extra jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss": "https://login.example.com",
+		"aud": "diener",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "alice",
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTAuth(t *testing.T) {
+	key := newTestKey(t, "k1")
+	other := newTestKey(t, "k1")
+	cfg := ctx.JWTConfig{
+		Issuer:   "https://login.example.com",
+		Audience: "diener",
+		JWKS:     jwksOf(key),
+	}
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims(nil)).SignedString(key.public)
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{name: "valid", token: key.sign(t, validClaims(nil)), status: http.StatusOK},
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "garbage", token: "not.a.jwt", status: http.StatusUnauthorized},
+		{name: "other issuer", token: key.sign(t, validClaims(jwt.MapClaims{"iss": "https://evil.example.com"})), status: http.StatusUnauthorized},
+		{name: "other audience", token: key.sign(t, validClaims(jwt.MapClaims{"aud": "other"})), status: http.StatusUnauthorized},
+		{name: "audience in list", token: key.sign(t, validClaims(jwt.MapClaims{"aud": []string{"other", "diener"}})), status: http.StatusOK},
+		{name: "expired", token: key.sign(t, validClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), status: http.StatusUnauthorized},
+		{name: "expired within leeway", token: key.sign(t, validClaims(jwt.MapClaims{"exp": time.Now().Add(-10 * time.Second).Unix()})), status: http.StatusOK},
+		{name: "without expiry", token: key.sign(t, validClaims(jwt.MapClaims{"exp": nil})), status: http.StatusUnauthorized},
+		{name: "signed by other key", token: other.sign(t, validClaims(nil)), status: http.StatusUnauthorized},
+		{name: "hmac with the public key", token: hs256, status: http.StatusUnauthorized},
+		{name: "unguarded method", method: http.MethodPut, status: http.StatusOK},
+	}
+	ja := NewJWTAuth(zerolog.Nop(), cfg, "/", http.MethodGet, http.MethodHead)
+	handler := ja.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/file", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestJWTAuthWithoutKeys(t *testing.T) {
+	key := newTestKey(t, "k1")
+	for name, cfg := range map[string]ctx.JWTConfig{
+		"no audience": {Issuer: "https://login.example.com", JWKS: jwksOf(key)},
+		"no jwks":     {Issuer: "https://login.example.com", Audience: "diener"},
+		"broken jwks": {Issuer: "https://login.example.com", Audience: "diener", JWKS: []byte("{")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ja := NewJWTAuth(zerolog.Nop(), cfg, "/", http.MethodGet)
+			handler := ja.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/file", nil)
+			r.Header.Set("Authorization", "Bearer "+key.sign(t, validClaims(nil)))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want 401", w.Code)
+			}
+		})
+	}
+}
+
+func TestJWTAuthPrefixes(t *testing.T) {
+	key := newTestKey(t, "k1")
+	cfg := ctx.JWTConfig{
+		Issuer:   "https://login.example.com",
+		Audience: "diener",
+		JWKS:     jwksOf(key),
+		Prefixes: []ctx.JWTPrefixRule{
+			{Claim: "groups", Value: "design", Prefixes: []string{"design/", "/shared/"}},
+			{Claim: "sub", Prefixes: []string{"home/{value}/"}},
+			{Claim: "team", Prefixes: []string{"{value}/"}},
+		},
+	}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		path   string
+		status int
+	}{
+		{name: "group prefix", claims: jwt.MapClaims{"groups": []string{"staff", "design"}}, path: "/files/design/logo.svg", status: http.StatusOK},
+		{name: "second group prefix", claims: jwt.MapClaims{"groups": "design"}, path: "/files/shared/a.txt", status: http.StatusOK},
+		{name: "other group", claims: jwt.MapClaims{"groups": []string{"staff"}}, path: "/files/design/logo.svg", status: http.StatusForbidden},
+		{name: "listing the prefix", claims: jwt.MapClaims{"groups": "design"}, path: "/files/design", status: http.StatusOK},
+		{name: "not a sibling", claims: jwt.MapClaims{"groups": "design"}, path: "/files/designer/a.txt", status: http.StatusForbidden},
+		{name: "escape with dot dot", claims: jwt.MapClaims{"groups": "design"}, path: "/files/design/../secret/a.txt", status: http.StatusForbidden},
+		{name: "own home", path: "/files/home/alice/a.txt", status: http.StatusOK},
+		{name: "other home", path: "/files/home/bob/a.txt", status: http.StatusForbidden},
+		{name: "empty sub", claims: jwt.MapClaims{"sub": ""}, path: "/files/home//a.txt", status: http.StatusForbidden},
+		{name: "empty value drops the prefix", claims: jwt.MapClaims{"sub": nil, "team": ""}, path: "/files/secret/a.txt", status: http.StatusForbidden},
+		{name: "dot value", claims: jwt.MapClaims{"sub": nil, "team": "."}, path: "/files/secret/a.txt", status: http.StatusForbidden},
+		{name: "dot dot value", claims: jwt.MapClaims{"sub": nil, "team": ".."}, path: "/files/secret/a.txt", status: http.StatusForbidden},
+		{name: "slash in value", claims: jwt.MapClaims{"sub": nil, "team": "a/../secret"}, path: "/files/secret/a.txt", status: http.StatusForbidden},
+		{name: "team prefix", claims: jwt.MapClaims{"sub": nil, "team": "red"}, path: "/files/red/a.txt", status: http.StatusOK},
+	}
+	ja := NewJWTAuth(zerolog.Nop(), cfg, "/files", http.MethodGet)
+	handler := ja.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+key.sign(t, validClaims(tt.claims)))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
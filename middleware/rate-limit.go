@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimitIdle is how long the bucket of a key is kept unused, it is
+	// full again long before
+	rateLimitIdle = 10 * time.Minute
+	// rateLimitMaxBuckets bounds the memory of clients making up keys,
+	// the least recently used bucket goes first
+	rateLimitMaxBuckets = 100000
+)
+
+type rateLimitBucket struct {
+	key     string
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// RateLimit answers requests over the limit of their key with 429 and
+// counts them in diener.ratelimit.rejected.
+type RateLimit struct {
+	log      zerolog.Logger
+	limit    rate.Limit
+	burst    int
+	key      string
+	header   string
+	route    string
+	rejected metric.Int64Counter
+	mu       sync.Mutex
+	buckets  map[string]*list.Element
+	// lru holds the buckets, the most recently used first
+	lru        *list.List
+	maxBuckets int
+}
+
+// NewRateLimit keys the buckets by client IP unless the key is "route"
+// or "header:<name>", requests without the header fall back to their IP.
+// The burst is at least one request.
+func NewRateLimit(log zerolog.Logger, meter metric.Meter, route string, cfg ctx.RateLimitConfig) *RateLimit {
+	rl := &RateLimit{
+		log:        log.With().Str("component", "rate-limit").Str("route", route).Logger(),
+		limit:      rate.Limit(cfg.RequestsPerSecond),
+		burst:      cfg.Burst,
+		key:        "ip",
+		route:      route,
+		buckets:    map[string]*list.Element{},
+		lru:        list.New(),
+		maxBuckets: rateLimitMaxBuckets,
+	}
+	if rl.burst < 1 {
+		rl.burst = int(math.Max(1, math.Ceil(cfg.RequestsPerSecond)))
+	}
+	switch {
+	case cfg.Key == "route":
+		rl.key = "route"
+	case strings.HasPrefix(strings.ToLower(cfg.Key), "header:"):
+		rl.key = "header"
+		rl.header = strings.TrimSpace(cfg.Key[len("header:"):])
+	case cfg.Key != "" && cfg.Key != "ip":
+		rl.log.Warn().Str("key", cfg.Key).Msg("unknown rate limit key, using ip")
+	}
+	rejected, err := meter.Int64Counter("diener.ratelimit.rejected",
+		metric.WithDescription("requests refused with 429 by a rate limit"))
+	if err != nil {
+		rl.log.Error().Err(err).Msg("rejected counter")
+	}
+	rl.rejected = rejected
+	return rl
+}
+
+// ipKey is the IP of IPv4 clients and the /64 of IPv6 clients, which
+// usually have a whole /64 to pick addresses from.
+func ipKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr.String()
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix.String()
+}
+
+func (rl *RateLimit) bucketKey(r *http.Request) string {
+	switch rl.key {
+	case "route":
+		return ""
+	case "header":
+		if value := r.Header.Get(rl.header); value != "" {
+			return "header:" + value
+		}
+	}
+	return "ip:" + ipKey(ClientIP(r))
+}
+
+// bucket is the bucket of the key. Before a new one is made idle buckets
+// are dropped, and the least recently used one if there are too many.
+func (rl *RateLimit) bucket(key string, now time.Time) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if e, found := rl.buckets[key]; found {
+		b := e.Value.(*rateLimitBucket)
+		b.seen = now
+		rl.lru.MoveToFront(e)
+		return b.limiter
+	}
+	for e := rl.lru.Back(); e != nil; e = rl.lru.Back() {
+		b := e.Value.(*rateLimitBucket)
+		if now.Sub(b.seen) <= rateLimitIdle && rl.lru.Len() < rl.maxBuckets {
+			break
+		}
+		rl.lru.Remove(e)
+		delete(rl.buckets, b.key)
+	}
+	b := &rateLimitBucket{key: key, limiter: rate.NewLimiter(rl.limit, rl.burst), seen: now}
+	rl.buckets[key] = rl.lru.PushFront(b)
+	return b.limiter
+}
+
+func (rl *RateLimit) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		key := rl.bucketKey(r)
+		reservation := rl.bucket(key, now).ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if !reservation.OK() || delay > 0 {
+			// a refused request takes no token
+			reservation.CancelAt(now)
+			if rl.rejected != nil {
+				rl.rejected.Add(r.Context(), 1, metric.WithAttributes(
+					attribute.String("route", rl.route),
+					attribute.String("key", rl.key),
+				))
+			}
+			// header values may be secrets, the client IP tells enough
+			rl.log.Info().Str("ip", ClientIP(r)).Dur("delay", delay).Msg("rate limited")
+			if delay > time.Hour {
+				// a request over the burst never gets its tokens
+				delay = time.Hour
+			}
+			retryAfter := int(math.Max(1, math.Ceil(delay.Seconds())))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mabels/diener/ctx"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func newTestRateLimit(cfg ctx.RateLimitConfig) *RateLimit {
+	return NewRateLimit(zerolog.Nop(), noop.NewMeterProvider().Meter("test"), "ns/test example.com/", cfg)
+}
+
+func TestRateLimit(t *testing.T) {
+	type request struct {
+		remoteAddr string
+		header     string
+		status     int
+		retryAfter string
+	}
+	tests := []struct {
+		name     string
+		cfg      ctx.RateLimitConfig
+		requests []request
+	}{
+		{
+			name: "burst then 429",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1, Burst: 2},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:2", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:3", status: http.StatusTooManyRequests, retryAfter: "1"},
+				{remoteAddr: "192.0.2.2:1", status: http.StatusOK},
+			},
+		},
+		{
+			name: "retry after the refill",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 0.1},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1", status: http.StatusTooManyRequests, retryAfter: "10"},
+			},
+		},
+		{
+			name: "ipv6 clients share their /64",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1},
+			requests: []request{
+				{remoteAddr: "[2001:db8:1:2::1]:1", status: http.StatusOK},
+				{remoteAddr: "[2001:db8:1:2:ffff::2]:1", status: http.StatusTooManyRequests, retryAfter: "1"},
+				{remoteAddr: "[2001:db8:1:3::1]:1", status: http.StatusOK},
+			},
+		},
+		{
+			name: "mapped ipv4 is ipv4",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1},
+			requests: []request{
+				{remoteAddr: "[::ffff:192.0.2.1]:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1", status: http.StatusTooManyRequests, retryAfter: "1"},
+				{remoteAddr: "192.0.2.2:1", status: http.StatusOK},
+			},
+		},
+		{
+			name: "one bucket for the route",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1, Key: "route"},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.2:1", status: http.StatusTooManyRequests, retryAfter: "1"},
+			},
+		},
+		{
+			name: "per header value, ip without it",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1, Key: "header:X-Api-Key"},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1", header: "a", status: http.StatusOK},
+				{remoteAddr: "192.0.2.2:1", header: "a", status: http.StatusTooManyRequests, retryAfter: "1"},
+				{remoteAddr: "192.0.2.1:1", header: "b", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1", status: http.StatusTooManyRequests, retryAfter: "1"},
+			},
+		},
+		{
+			name: "unknown key is ip",
+			cfg:  ctx.RateLimitConfig{RequestsPerSecond: 1, Key: "cookie"},
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1", status: http.StatusOK},
+				{remoteAddr: "192.0.2.2:1", status: http.StatusOK},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestRateLimit(tt.cfg).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = req.remoteAddr
+				if req.header != "" {
+					r.Header.Set("X-Api-Key", req.header)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != req.status {
+					t.Errorf("request %d: status %d, want %d", i, w.Code, req.status)
+				}
+				if got := w.Header().Get("Retry-After"); got != req.retryAfter {
+					t.Errorf("request %d: Retry-After %q, want %q", i, got, req.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	rl := newTestRateLimit(ctx.RateLimitConfig{RequestsPerSecond: 1})
+	rl.maxBuckets = 3
+	now := time.Now()
+	first := rl.bucket("a", now)
+	rl.bucket("b", now)
+	rl.bucket("c", now)
+	// a is used again, b is the least recently used now
+	rl.bucket("a", now)
+	rl.bucket("d", now)
+	if len(rl.buckets) != 3 || rl.lru.Len() != 3 {
+		t.Fatalf("%d buckets, %d in lru, want 3", len(rl.buckets), rl.lru.Len())
+	}
+	if _, found := rl.buckets["b"]; found {
+		t.Error("least recently used bucket b kept")
+	}
+	if rl.bucket("a", now) != first {
+		t.Error("recently used bucket a dropped")
+	}
+
+	// idle buckets go before a new one is made
+	rl.bucket("e", now.Add(rateLimitIdle+time.Second))
+	if len(rl.buckets) != 1 {
+		t.Errorf("%d buckets after all went idle, want 1", len(rl.buckets))
+	}
+}
+
+func TestRateLimitBucketCap(t *testing.T) {
+	rl := newTestRateLimit(ctx.RateLimitConfig{RequestsPerSecond: 1})
+	now := time.Now()
+	for i := 0; i < rateLimitMaxBuckets+100; i++ {
+		rl.bucket(fmt.Sprint(i), now)
+	}
+	if len(rl.buckets) != rateLimitMaxBuckets {
+		t.Errorf("%d buckets, want at most %d", len(rl.buckets), rateLimitMaxBuckets)
+	}
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSignedURL(t *testing.T) {
+	oldKey, newKey := []byte("old-key"), []byte("new-key")
+	signed := func(key []byte, target string, expires time.Time, ip string) string {
+		u, _ := url.Parse(target)
+		SignURL(key, u, expires, ip)
+		return u.String()
+	}
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		remoteAddr string
+		status     int
+	}{
+		{name: "signed", target: signed(newKey, "/file.pdf", later, ""), status: http.StatusOK},
+		{name: "signed with the old key", target: signed(oldKey, "/file.pdf", later, ""), status: http.StatusOK},
+		{name: "signed with an unknown key", target: signed([]byte("other"), "/file.pdf", later, ""), status: http.StatusForbidden},
+		{name: "unsigned", target: "/file.pdf", status: http.StatusForbidden},
+		{name: "unguarded method", method: http.MethodPut, target: "/file.pdf", status: http.StatusOK},
+		{name: "expired", target: signed(newKey, "/file.pdf", time.Now().Add(-time.Second), ""), status: http.StatusForbidden},
+		{name: "extra query parameter", target: signed(newKey, "/file.pdf", later, "") + "&x=/other.pdf", status: http.StatusOK},
+		{name: "expiry moved", target: func() string {
+			u, _ := url.Parse(signed(newKey, "/file.pdf", later, ""))
+			q := u.Query()
+			q.Set(ExpiresParam, "9999999999")
+			u.RawQuery = q.Encode()
+			return u.String()
+		}(), status: http.StatusForbidden},
+		{name: "signature for another path", target: func() string {
+			u, _ := url.Parse(signed(newKey, "/public.pdf", later, ""))
+			u.Path = "/file.pdf"
+			return u.String()
+		}(), status: http.StatusForbidden},
+		{name: "bound to the client", target: signed(newKey, "/file.pdf", later, "192.0.2.1"), remoteAddr: "192.0.2.1:4711", status: http.StatusOK},
+		{name: "bound to another client", target: signed(newKey, "/file.pdf", later, "192.0.2.1"), remoteAddr: "192.0.2.2:4711", status: http.StatusForbidden},
+		{name: "binding dropped", target: func() string {
+			u, _ := url.Parse(signed(newKey, "/file.pdf", later, "192.0.2.1"))
+			q := u.Query()
+			q.Del(IPParam)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}(), remoteAddr: "192.0.2.2:4711", status: http.StatusForbidden},
+	}
+	su := NewSignedURL(zerolog.Nop(), []string{string(newKey), "", string(oldKey)}, http.MethodGet, http.MethodHead)
+	handler := su.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.target, nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// TestSignedURLClientIP checks that the binding uses the client IP the
+// trusted proxies derived.
+func TestSignedURLClientIP(t *testing.T) {
+	key := []byte("key")
+	u, _ := url.Parse("/file.pdf")
+	SignURL(key, u, time.Now().Add(time.Hour), "198.51.100.7")
+	su := NewSignedURL(zerolog.Nop(), []string{string(key)}, http.MethodGet)
+	r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r = r.WithContext(WithClientIP(r.Context(), "198.51.100.7"))
+	w := httptest.NewRecorder()
+	su.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", w.Code)
+	}
+}
+
+func TestSignedURLWithoutKeys(t *testing.T) {
+	u, _ := url.Parse("/file.pdf")
+	SignURL([]byte(""), u, time.Now().Add(time.Hour), "")
+	su := NewSignedURL(zerolog.Nop(), []string{""}, http.MethodGet)
+	r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+	w := httptest.NewRecorder()
+	su.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", w.Code)
+	}
+}
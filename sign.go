@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mabels/diener/middleware"
+	"github.com/spf13/pflag"
+)
+
+// signingKey is the first line of the key file like the routes read it
+// from the Secret, else DIENER_SIGNING_KEY.
+func signingKey(keyFile string) (string, error) {
+	value := os.Getenv("DIENER_SIGNING_KEY")
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		value = string(content)
+	}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+	}
+	return "", errors.New("no signing key, use --key-file or DIENER_SIGNING_KEY")
+}
+
+// signCommand prints the signed form of the URLs given as arguments.
+func signCommand(args []string) error {
+	flags := pflag.NewFlagSet("sign", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: diener sign [flags] URL...")
+		flags.PrintDefaults()
+	}
+	var keyFile string
+	flags.StringVar(&keyFile, "key-file", "", "file holding the HMAC key of the signedURLs Secret")
+	var expires time.Duration
+	flags.DurationVar(&expires, "expires", time.Hour, "how long the URL stays valid")
+	var ip string
+	flags.StringVar(&ip, "ip", "", "client IP the URL is bound to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no URL to sign")
+	}
+	key, err := signingKey(keyFile)
+	if err != nil {
+		return err
+	}
+	until := time.Now().Add(expires)
+	for _, arg := range flags.Args() {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		middleware.SignURL([]byte(key), u, until, ip)
+		fmt.Println(u.String())
+	}
+	return nil
+}